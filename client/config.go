@@ -3,23 +3,47 @@ package main
 import (
 	"encoding/json"
 	"os"
+
+	"github.com/shadowsocks/kcptun/generic"
 )
 
 // Config for client
 type Config struct {
 	LocalAddr    string `json:"localaddr"`
+	UnixMode     string `json:"unixmode"`
+	UnixOwner    string `json:"unixowner"`
+	AcceptProxy  bool   `json:"acceptproxy"`
 	RemoteAddr   string `json:"remoteaddr"`
+	Probe        int    `json:"probe"`
+	StreamHdr    bool   `json:"streamhdr"`
+	HalfClose    bool   `json:"halfclose"`
+	User         string `json:"user"`
 	Key          string `json:"key"`
 	Crypt        string `json:"crypt"`
 	Mode         string `json:"mode"`
 	Conn         int    `json:"conn"`
+	MaxConn      int    `json:"maxconn"`
+	ScaleStreams int    `json:"scalestreams"`
+	ScaleBps     int    `json:"scalebps"`
+	ScaleIdle    int    `json:"scaleidle"`
+	SessionLB    string `json:"sessionlb"`
+	ConnWait     int    `json:"connwait"`
+	ConnQueue    int    `json:"connqueue"`
 	AutoExpire   int    `json:"autoexpire"`
 	ScavengeTTL  int    `json:"scavengettl"`
+	DrainGrace   int    `json:"draingrace"`
 	MTU          int    `json:"mtu"`
+	PMTUD        bool   `json:"pmtud"`
 	SndWnd       int    `json:"sndwnd"`
 	RcvWnd       int    `json:"rcvwnd"`
+	CC           string `json:"cc"`
+	CCBandwidth  int    `json:"ccbandwidth"`
+	Pacing       bool   `json:"pacing"`
 	DataShard    int    `json:"datashard"`
 	ParityShard  int    `json:"parityshard"`
+	AdaptiveFEC  bool   `json:"adaptivefec"`
+	MinParity    int    `json:"minparity"`
+	MaxParity    int    `json:"maxparity"`
 	DSCP         int    `json:"dscp"`
 	NoComp       bool   `json:"nocomp"`
 	AckNodelay   bool   `json:"acknodelay"`
@@ -29,11 +53,36 @@ type Config struct {
 	NoCongestion int    `json:"nc"`
 	SockBuf      int    `json:"sockbuf"`
 	KeepAlive    int    `json:"keepalive"`
+	CloseWait    int    `json:"closewait"`
+	StreamIdle   int    `json:"streamidle"`
+	StreamLife   int    `json:"streamlife"`
+	RateLimit    int    `json:"ratelimit"`
+	SessionRate  int    `json:"sessionrate"`
+	StreamRate   int    `json:"streamrate"`
 	Log          string `json:"log"`
 	SnmpLog      string `json:"snmplog"`
 	SnmpPeriod   int    `json:"snmpperiod"`
 	Quiet        bool   `json:"quiet"`
 	Vpn          bool   `json:"vpn"`
+
+	// Profiles are the tuning profiles selectable by mode
+	Profiles map[string]*generic.Profile `json:"profiles"`
+}
+
+// profileOptions returns the options of config set by tuning profiles
+func (config *Config) profileOptions() generic.Options {
+	return generic.Options{
+		NoDelay:      &config.NoDelay,
+		Interval:     &config.Interval,
+		Resend:       &config.Resend,
+		NoCongestion: &config.NoCongestion,
+		SndWnd:       &config.SndWnd,
+		RcvWnd:       &config.RcvWnd,
+		MTU:          &config.MTU,
+		DataShard:    &config.DataShard,
+		ParityShard:  &config.ParityShard,
+		AckNodelay:   &config.AckNodelay,
+	}
 }
 
 func parseJSONConfig(config *Config, path string) error {
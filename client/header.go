@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// stream header, written by the client as the first bytes of every stream
+// when --streamhdr is set, the server must be started with --streamhdr too.
+//
+// |  VER(1B)  |  CMD(1B)  |  LENGTH(2B)  |  FIELDS(LENGTH)  |
+//
+// FIELDS is a sequence of | TYPE(1B) | LEN(1B) | VALUE(LEN) |
+const (
+	hdrVersion = 1
+	hdrSize    = 4
+	hdrTimeout = 10 * time.Second // max time to wait for a header from the server
+)
+
+const (
+	// cmdConnect opens a stream to the target
+	cmdConnect byte = iota + 1
+	// cmdPing asks the server to answer with a single byte, used to probe remotes
+	cmdPing
+	// cmdDrain tells the server no more streams will be opened on the session
+	cmdDrain
+	// cmdFin tells the peer a stream won't send more data, it is sent on a
+	// stream of its own, either way
+	cmdFin
+)
+
+const (
+	// fieldSource is the address of the original client, IP(4B or 16B) + PORT(2B)
+	fieldSource byte = iota + 1
+	// fieldDest is the address the original client connected to, same encoding
+	fieldDest
+	// fieldHalfClose asks for half-closes to be propagated with cmdFin, no value
+	fieldHalfClose
+	// fieldStream is the id of the stream a cmdFin refers to, 4B
+	fieldStream
+	// fieldUser is the name the client accounts its traffic to, up to 255B
+	fieldUser
+)
+
+// writeStreamHeader sends a cmdConnect header carrying src and dst, addresses
+// which are not tcp(eg. unix sockets) are left out.
+func writeStreamHeader(w io.Writer, src, dst net.Addr, halfClose bool, user string) error {
+	var fields []byte
+	fields = appendAddrField(fields, fieldSource, src)
+	fields = appendAddrField(fields, fieldDest, dst)
+	if halfClose {
+		fields = append(fields, fieldHalfClose, 0)
+	}
+	if user != "" {
+		fields = append(fields, fieldUser, byte(len(user)))
+		fields = append(fields, user...)
+	}
+
+	buf := make([]byte, hdrSize, hdrSize+len(fields))
+	buf[0] = hdrVersion
+	buf[1] = cmdConnect
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(fields)))
+	buf = append(buf, fields...)
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "writeStreamHeader")
+	}
+	return nil
+}
+
+// writeCommand sends a header without fields, for control commands
+func writeCommand(w io.Writer, cmd byte) error {
+	hdr := []byte{hdrVersion, cmd, 0, 0}
+	if _, err := w.Write(hdr); err != nil {
+		return errors.Wrap(err, "writeCommand")
+	}
+	return nil
+}
+
+// writeFin sends a cmdFin header for the stream id
+func writeFin(w io.Writer, id uint32) error {
+	buf := []byte{hdrVersion, cmdFin, 0, 6, fieldStream, 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[6:], id)
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "writeFin")
+	}
+	return nil
+}
+
+// sendFin announces the end of data on the stream id
+func sendFin(sess *smux.Session, id uint32) error {
+	s, err := sess.OpenStream()
+	if err != nil {
+		return errors.Wrap(err, "sendFin")
+	}
+	defer s.Close()
+	return writeFin(s, id)
+}
+
+// readFin reads a cmdFin header sent by the server, returning the stream id
+func readFin(r io.Reader) (uint32, error) {
+	var hdr [hdrSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, errors.Wrap(err, "readFin")
+	}
+	if hdr[0] != hdrVersion || hdr[1] != cmdFin {
+		return 0, errors.Errorf("readFin: unexpected header %v %v", hdr[0], hdr[1])
+	}
+	fields := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return 0, errors.Wrap(err, "readFin")
+	}
+	for len(fields) >= 2 && len(fields) >= 2+int(fields[1]) {
+		typ, value := fields[0], fields[2:2+int(fields[1])]
+		fields = fields[2+len(value):]
+		if typ == fieldStream && len(value) == 4 {
+			return binary.BigEndian.Uint32(value), nil
+		}
+	}
+	return 0, errors.New("readFin: no stream field")
+}
+
+func appendAddrField(fields []byte, typ byte, addr net.Addr) []byte {
+	tcpaddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fields
+	}
+	ip := tcpaddr.IP.To4()
+	if ip == nil {
+		ip = tcpaddr.IP.To16()
+	}
+	if ip == nil {
+		return fields
+	}
+	fields = append(fields, typ, byte(len(ip)+2))
+	fields = append(fields, ip...)
+	return append(fields, byte(tcpaddr.Port>>8), byte(tcpaddr.Port))
+}
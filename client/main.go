@@ -16,6 +16,7 @@ import (
 
 	"github.com/golang/snappy"
 	"github.com/pkg/errors"
+	"github.com/shadowsocks/kcptun/generic"
 	"github.com/urfave/cli"
 	"github.com/xtaci/kcp-go"
 	"github.com/xtaci/smux"
@@ -29,6 +30,14 @@ var (
 	// SALT is use for pbkdf2 key expansion
 	SALT = "kcp-go"
 	VpnMode = false
+	// statsPool is the session pool reported on SIGUSR1
+	statsPool *sessionPool
+	// limits are the rate limits, reloaded on SIGHUP and reported on SIGUSR1
+	limits *rateLimits
+	// fecTotals are the adaptive FEC statistics, reported on SIGUSR1
+	fecTotals *generic.FECCounters
+	// paceTotals are the paced peers, reported on SIGUSR1
+	paceTotals *generic.PaceStats
 )
 
 type compStream struct {
@@ -59,33 +68,74 @@ func newCompStream(conn net.Conn) *compStream {
 	return c
 }
 
-func handleClient(sess *smux.Session, p1 io.ReadWriteCloser, quiet bool) {
+// kcpConn is a kcp session closing along with it the socket it was dialed on
+type kcpConn struct {
+	*kcp.UDPSession
+	sock io.Closer
+}
 
-	// if !quiet {
-	// 	log.Println("stream opened")
-	// 	defer log.Println("stream closed")
-	// }
+func (c *kcpConn) Close() error {
+	err := c.UDPSession.Close()
+	c.sock.Close()
+	return err
+}
 
+func handleClient(t *tunnel, p1 net.Conn, rl *rateLimits, config *Config) {
 	defer p1.Close()
-	p2, err := sess.OpenStream()
+	if config.AcceptProxy {
+		conn, err := acceptProxyHeader(p1)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		p1 = conn
+	}
+
+	p2, err := t.session.OpenStream()
 	if err != nil {
 		return
 	}
 	defer p2.Close()
 
-	// start tunnel
-	p1die := make(chan struct{})
-	buf1 := make([]byte, 65535)
-	go func() { io.CopyBuffer(p1, p2, buf1); close(p1die) }()
+	if !config.Quiet {
+		log.Println("stream opened", "in:", p1.RemoteAddr(), "session:", t.conv(), "remote:", t.remote.addr)
+	}
+
+	if config.StreamHdr {
+		if err := writeStreamHeader(p2, p1.RemoteAddr(), p1.LocalAddr(), config.HalfClose, config.User); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	watch := generic.NewStreamWatch(time.Duration(config.StreamIdle)*time.Second, time.Duration(config.StreamLife)*time.Second)
+	defer watch.Stop()
+	buckets := []*bucket{t.bucket, rl.newStreamBucket()}
+	toLocal := watch.Writer(rl.writer(&tunnelWriter{Writer: p1, t: t}, buckets...))
+	toStream := watch.Writer(rl.writer(&tunnelWriter{Writer: p2, t: t, stream: true}, buckets...))
+
+	var reason string
+	if config.HalfClose {
+		reason = generic.HalfCloseCopy(p2, p1, toStream, toLocal, watch, t.fins, func(id uint32) error { return sendFin(t.session, id) })
+	} else {
+		// start tunnel
+		p1die := make(chan struct{})
+		go func() { generic.CopyBuffer(toLocal, p2); close(p1die) }()
 
-	p2die := make(chan struct{})
-	buf2 := make([]byte, 65535)
-	go func() { io.CopyBuffer(p2, p1, buf2); close(p2die) }()
+		p2die := make(chan struct{})
+		go func() { generic.CopyBuffer(toStream, p1); close(p2die) }()
 
-	// wait for tunnel termination
-	select {
-	case <-p1die:
-	case <-p2die:
+		// wait for tunnel termination
+		select {
+		case <-p1die:
+			reason = "remote closed"
+		case <-p2die:
+			reason = "local closed"
+		case reason = <-watch.Reason:
+		}
+	}
+	if !config.Quiet || generic.TimedOut(reason) {
+		log.Println("stream closed", "in:", p1.RemoteAddr(), "session:", t.conv(), "reason:", reason)
 	}
 }
 
@@ -110,12 +160,44 @@ func main() {
 		cli.StringFlag{
 			Name:  "localaddr,l",
 			Value: ":12948",
-			Usage: "local listen address",
+			Usage: "local listen address, or unix:/path for a unix domain socket",
+		},
+		cli.StringFlag{
+			Name:  "unixmode",
+			Value: "",
+			Usage: "set file mode of the local unix socket, like: 0660",
+		},
+		cli.StringFlag{
+			Name:  "unixowner",
+			Value: "",
+			Usage: "set owner of the local unix socket, like: user:group",
+		},
+		cli.BoolFlag{
+			Name:  "acceptproxy",
+			Usage: "expect a PROXY protocol v1/v2 header on each local connection",
 		},
 		cli.StringFlag{
 			Name:  "remoteaddr, r",
 			Value: "vps:29900",
-			Usage: "kcp server address",
+			Usage: "kcp server address, separate multiple servers by comma, each as host:port[/priority[/weight[/profile]]]",
+		},
+		cli.IntFlag{
+			Name:  "probe",
+			Value: 5,
+			Usage: "seconds between probes of multiple kcp servers, pinged with --streamhdr, else measured by the kcp rtt of an idle session, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name:  "streamhdr",
+			Usage: "send a header carrying the original client address on each stream, must match the server",
+		},
+		cli.BoolFlag{
+			Name:  "halfclose",
+			Usage: "propagate TCP half-closes through the tunnel, requires --streamhdr",
+		},
+		cli.StringFlag{
+			Name:  "user",
+			Value: "",
+			Usage: "name the server accounts the traffic of this client to, requires --streamhdr and the name in the server --quotausers",
 		},
 		cli.StringFlag{
 			Name:   "key",
@@ -131,13 +213,48 @@ func main() {
 		cli.StringFlag{
 			Name:  "mode",
 			Value: "fast",
-			Usage: "profiles: fast3, fast2, fast, normal, manual",
+			Usage: "profiles: fast3, fast2, fast, normal, manual, auto, or a profile of the config file",
 		},
 		cli.IntFlag{
 			Name:  "conn",
 			Value: 1,
 			Usage: "set num of UDP connections to server",
 		},
+		cli.IntFlag{
+			Name:  "maxconn",
+			Value: 0,
+			Usage: "grow the num of UDP connections up to maxconn under load, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "scalestreams",
+			Value: 64,
+			Usage: "average streams per UDP connection to add a connection, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "scalebps",
+			Value: 0,
+			Usage: "average bytes per second per UDP connection to add a connection, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "scaleidle",
+			Value: 60,
+			Usage: "seconds a UDP connection stays idle before it's removed, down to --conn connections",
+		},
+		cli.StringFlag{
+			Name:  "sessionlb",
+			Value: "rr",
+			Usage: "how streams are placed on UDP connections: rr, leaststreams, rtt, sendqueue",
+		},
+		cli.IntFlag{
+			Name:  "connwait",
+			Value: 10,
+			Usage: "seconds a local connection waits for a UDP connection to become ready",
+		},
+		cli.IntFlag{
+			Name:  "connqueue",
+			Value: 1024,
+			Usage: "max number of local connections waiting for a UDP connection",
+		},
 		cli.IntFlag{
 			Name:  "autoexpire",
 			Value: 10,
@@ -148,11 +265,20 @@ func main() {
 			Value: 600,
 			Usage: "set how long an expired connection can live(in sec), -1 to disable",
 		},
+		cli.IntFlag{
+			Name:  "draingrace",
+			Value: 0,
+			Usage: "set how long an expired connection can drain waiting for its streams to end(in sec), independent of scavengettl, 0 to disable",
+		},
 		cli.IntFlag{
 			Name:  "mtu",
 			Value: 1350,
 			Usage: "set maximum transmission unit for UDP packets",
 		},
+		cli.BoolFlag{
+			Name:  "pmtud",
+			Usage: "discover the path mtu by probing with the DF bit set, --mtu is used when probing fails, must be set on both sides",
+		},
 		cli.IntFlag{
 			Name:  "sndwnd",
 			Value: 128,
@@ -163,6 +289,20 @@ func main() {
 			Value: 512,
 			Usage: "set receive window size(num of packets)",
 		},
+		cli.StringFlag{
+			Name:  "cc",
+			Value: "kcp",
+			Usage: "congestion control: kcp (set by nc), bbr, fair (bbr capped to a fair share of --ccbandwidth), bbr and fair pace the packets of each session",
+		},
+		cli.IntFlag{
+			Name:  "ccbandwidth",
+			Value: 0,
+			Usage: "bandwidth in bytes per second shared evenly among the sessions by the fair congestion control",
+		},
+		cli.BoolFlag{
+			Name:  "pacing",
+			Usage: "pace the packets of each session at its estimated bandwidth instead of flushing the send window in bursts, implied by --cc bbr and fair",
+		},
 		cli.IntFlag{
 			Name:  "datashard,ds",
 			Value: 10,
@@ -173,6 +313,20 @@ func main() {
 			Value: 3,
 			Usage: "set reed-solomon erasure coding - parityshard",
 		},
+		cli.BoolFlag{
+			Name:  "adaptivefec",
+			Usage: "tune the parity shards to the measured loss, --datashard and --parityshard become the initial ratio, must be set on both sides",
+		},
+		cli.IntFlag{
+			Name:  "minparity",
+			Value: 0,
+			Usage: "lowest parity shards of the adaptive fec",
+		},
+		cli.IntFlag{
+			Name:  "maxparity",
+			Value: 10,
+			Usage: "highest parity shards of the adaptive fec",
+		},
 		cli.IntFlag{
 			Name:  "dscp",
 			Value: 0,
@@ -217,6 +371,36 @@ func main() {
 			Value: 10, // nat keepalive interval in seconds
 			Usage: "seconds between heartbeats",
 		},
+		cli.IntFlag{
+			Name:  "closewait",
+			Value: 30,
+			Usage: "seconds to wait for streams to finish on SIGTERM",
+		},
+		cli.IntFlag{
+			Name:  "streamidle",
+			Value: 0,
+			Usage: "seconds a stream may stay without traffic before it is closed, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "streamlife",
+			Value: 0,
+			Usage: "maximum lifetime of a stream in seconds, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "ratelimit",
+			Value: 0,
+			Usage: "total bandwidth limit in bytes per second, both directions, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "sessionrate",
+			Value: 0,
+			Usage: "bandwidth limit per session in bytes per second, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "streamrate",
+			Value: 0,
+			Usage: "bandwidth limit per stream in bytes per second, 0 for unlimited",
+		},
 		cli.StringFlag{
 			Name:  "snmplog",
 			Value: "",
@@ -250,22 +434,57 @@ func main() {
 			Usage: "Enable VPN mode for shadowsocks-android",
 		},
 	}
+	myApp.Commands = []cli.Command{
+		{
+			Name:  "profiles",
+			Usage: "print the built-in tuning profiles and those of the config file",
+			Action: func(c *cli.Context) error {
+				var config Config
+				if path := c.GlobalString("c"); path != "" {
+					checkError(parseJSONConfig(&config, path))
+				}
+				return generic.PrintProfiles(config.Profiles)
+			},
+		},
+	}
 	myApp.Action = func(c *cli.Context) error {
 		config := Config{}
 
 		config.LocalAddr = c.String("localaddr")
+		config.UnixMode = c.String("unixmode")
+		config.UnixOwner = c.String("unixowner")
+		config.AcceptProxy = c.Bool("acceptproxy")
 		config.RemoteAddr = c.String("remoteaddr")
+		config.Probe = c.Int("probe")
+		config.StreamHdr = c.Bool("streamhdr")
+		config.HalfClose = c.Bool("halfclose")
+		config.User = c.String("user")
 		config.Key = c.String("key")
 		config.Crypt = c.String("crypt")
 		config.Mode = c.String("mode")
 		config.Conn = c.Int("conn")
+		config.MaxConn = c.Int("maxconn")
+		config.ScaleStreams = c.Int("scalestreams")
+		config.ScaleBps = c.Int("scalebps")
+		config.ScaleIdle = c.Int("scaleidle")
+		config.SessionLB = c.String("sessionlb")
+		config.ConnWait = c.Int("connwait")
+		config.ConnQueue = c.Int("connqueue")
 		config.AutoExpire = c.Int("autoexpire")
 		config.ScavengeTTL = c.Int("scavengettl")
+		config.DrainGrace = c.Int("draingrace")
 		config.MTU = c.Int("mtu")
+		config.PMTUD = c.Bool("pmtud")
 		config.SndWnd = c.Int("sndwnd")
 		config.RcvWnd = c.Int("rcvwnd")
+		config.CC = c.String("cc")
+		config.CCBandwidth = c.Int("ccbandwidth")
+		config.Pacing = c.Bool("pacing")
 		config.DataShard = c.Int("datashard")
 		config.ParityShard = c.Int("parityshard")
+		config.AdaptiveFEC = c.Bool("adaptivefec")
+		config.MinParity = c.Int("minparity")
+		config.MaxParity = c.Int("maxparity")
 		config.DSCP = c.Int("dscp")
 		config.NoComp = c.Bool("nocomp")
 		config.AckNodelay = c.Bool("acknodelay")
@@ -275,6 +494,12 @@ func main() {
 		config.NoCongestion = c.Int("nc")
 		config.SockBuf = c.Int("sockbuf")
 		config.KeepAlive = c.Int("keepalive")
+		config.CloseWait = c.Int("closewait")
+		config.StreamIdle = c.Int("streamidle")
+		config.StreamLife = c.Int("streamlife")
+		config.RateLimit = c.Int("ratelimit")
+		config.SessionRate = c.Int("sessionrate")
+		config.StreamRate = c.Int("streamrate")
 		config.Log = c.String("log")
 		config.SnmpLog = c.String("snmplog")
 		config.SnmpPeriod = c.Int("snmpperiod")
@@ -292,9 +517,38 @@ func main() {
 			if c, b := opts.Get("localaddr"); b {
 				config.LocalAddr = c
 			}
+			if c, b := opts.Get("unixmode"); b {
+				config.UnixMode = c
+			}
+			if c, b := opts.Get("unixowner"); b {
+				config.UnixOwner = c
+			}
+			if c, b := opts.Get("acceptproxy"); b {
+				if acceptproxy, err := strconv.ParseBool(c); err == nil {
+					config.AcceptProxy = acceptproxy
+				}
+			}
 			if c, b := opts.Get("remoteaddr"); b {
 				config.RemoteAddr = c
 			}
+			if c, b := opts.Get("probe"); b {
+				if probe, err := strconv.Atoi(c); err == nil {
+					config.Probe = probe
+				}
+			}
+			if c, b := opts.Get("streamhdr"); b {
+				if streamhdr, err := strconv.ParseBool(c); err == nil {
+					config.StreamHdr = streamhdr
+				}
+			}
+			if c, b := opts.Get("halfclose"); b {
+				if halfclose, err := strconv.ParseBool(c); err == nil {
+					config.HalfClose = halfclose
+				}
+			}
+			if c, b := opts.Get("user"); b {
+				config.User = c
+			}
 			if c, b := opts.Get("key"); b {
 				config.Key = c
 			}
@@ -309,6 +563,39 @@ func main() {
 					config.Conn = conn
 				}
 			}
+			if c, b := opts.Get("maxconn"); b {
+				if maxconn, err := strconv.Atoi(c); err == nil {
+					config.MaxConn = maxconn
+				}
+			}
+			if c, b := opts.Get("scalestreams"); b {
+				if scalestreams, err := strconv.Atoi(c); err == nil {
+					config.ScaleStreams = scalestreams
+				}
+			}
+			if c, b := opts.Get("scalebps"); b {
+				if scalebps, err := strconv.Atoi(c); err == nil {
+					config.ScaleBps = scalebps
+				}
+			}
+			if c, b := opts.Get("scaleidle"); b {
+				if scaleidle, err := strconv.Atoi(c); err == nil {
+					config.ScaleIdle = scaleidle
+				}
+			}
+			if c, b := opts.Get("sessionlb"); b {
+				config.SessionLB = c
+			}
+			if c, b := opts.Get("connwait"); b {
+				if connwait, err := strconv.Atoi(c); err == nil {
+					config.ConnWait = connwait
+				}
+			}
+			if c, b := opts.Get("connqueue"); b {
+				if connqueue, err := strconv.Atoi(c); err == nil {
+					config.ConnQueue = connqueue
+				}
+			}
 			if c, b := opts.Get("autoexpire"); b {
 				if autoexpire, err := strconv.Atoi(c); err == nil {
 					config.AutoExpire = autoexpire
@@ -319,11 +606,21 @@ func main() {
 					config.ScavengeTTL = scavengettl
 				}
 			}
+			if c, b := opts.Get("draingrace"); b {
+				if draingrace, err := strconv.Atoi(c); err == nil {
+					config.DrainGrace = draingrace
+				}
+			}
 			if c, b := opts.Get("mtu"); b {
 				if mtu, err := strconv.Atoi(c); err == nil {
 					config.MTU = mtu
 				}
 			}
+			if c, b := opts.Get("pmtud"); b {
+				if pmtud, err := strconv.ParseBool(c); err == nil {
+					config.PMTUD = pmtud
+				}
+			}
 			if c, b := opts.Get("sndwnd"); b {
 				if sndwnd, err := strconv.Atoi(c); err == nil {
 					config.SndWnd = sndwnd
@@ -334,6 +631,19 @@ func main() {
 					config.RcvWnd = rcvwnd
 				}
 			}
+			if c, b := opts.Get("cc"); b {
+				config.CC = c
+			}
+			if c, b := opts.Get("ccbandwidth"); b {
+				if ccbandwidth, err := strconv.Atoi(c); err == nil {
+					config.CCBandwidth = ccbandwidth
+				}
+			}
+			if c, b := opts.Get("pacing"); b {
+				if pacing, err := strconv.ParseBool(c); err == nil {
+					config.Pacing = pacing
+				}
+			}
 			if c, b := opts.Get("datashard"); b {
 				if datashard, err := strconv.Atoi(c); err == nil {
 					config.DataShard = datashard
@@ -344,6 +654,21 @@ func main() {
 					config.ParityShard = parityshard
 				}
 			}
+			if c, b := opts.Get("adaptivefec"); b {
+				if adaptivefec, err := strconv.ParseBool(c); err == nil {
+					config.AdaptiveFEC = adaptivefec
+				}
+			}
+			if c, b := opts.Get("minparity"); b {
+				if minparity, err := strconv.Atoi(c); err == nil {
+					config.MinParity = minparity
+				}
+			}
+			if c, b := opts.Get("maxparity"); b {
+				if maxparity, err := strconv.Atoi(c); err == nil {
+					config.MaxParity = maxparity
+				}
+			}
 			if c, b := opts.Get("dscp"); b {
 				if dscp, err := strconv.Atoi(c); err == nil {
 					config.DSCP = dscp
@@ -389,6 +714,36 @@ func main() {
 					config.KeepAlive = keepalive
 				}
 			}
+			if c, b := opts.Get("closewait"); b {
+				if closewait, err := strconv.Atoi(c); err == nil {
+					config.CloseWait = closewait
+				}
+			}
+			if c, b := opts.Get("streamidle"); b {
+				if streamidle, err := strconv.Atoi(c); err == nil {
+					config.StreamIdle = streamidle
+				}
+			}
+			if c, b := opts.Get("streamlife"); b {
+				if streamlife, err := strconv.Atoi(c); err == nil {
+					config.StreamLife = streamlife
+				}
+			}
+			if c, b := opts.Get("ratelimit"); b {
+				if ratelimit, err := strconv.Atoi(c); err == nil {
+					config.RateLimit = ratelimit
+				}
+			}
+			if c, b := opts.Get("sessionrate"); b {
+				if sessionrate, err := strconv.Atoi(c); err == nil {
+					config.SessionRate = sessionrate
+				}
+			}
+			if c, b := opts.Get("streamrate"); b {
+				if streamrate, err := strconv.Atoi(c); err == nil {
+					config.StreamRate = streamrate
+				}
+			}
 			if c, b := opts.Get("log"); b {
 				config.Log = c
 			}
@@ -420,21 +775,32 @@ func main() {
 			log.SetOutput(f)
 		}
 
-		switch config.Mode {
-		case "normal":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
-		case "fast":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
-		case "fast2":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
-		case "fast3":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+		// auto starts as fast, then is tuned per session by generic.AutoTuner
+		mode, err := generic.LookupProfile(config.Mode, config.Profiles)
+		checkError(err)
+		mode.Apply(config.profileOptions())
+
+		var newCC generic.CCFactory
+		if config.CC != "kcp" {
+			newCC, err = generic.NewCCFactory(config.CC, config.CCBandwidth)
+			checkError(err)
+			// the controller replaces the congestion control of kcp
+			config.NoCongestion = 1
+		} else if config.Pacing {
+			// kcp keeps its congestion control, only the packets are paced
+			newCC = generic.NewPacing
 		}
 
-		log.Println("version:", VERSION)
-		addr, err := net.ResolveTCPAddr("tcp", config.LocalAddr)
+		rl := newRateLimits(config.RateLimit, config.SessionRate, config.StreamRate)
+		rl.path = c.String("c")
+		limits = rl
+
+		list, err := parseRemotes(config.RemoteAddr)
 		checkError(err)
-		listener, err := net.ListenTCP("tcp", addr)
+		remotes := &remoteSet{list}
+
+		log.Println("version:", VERSION)
+		listener, err := listenLocal(&config)
 		checkError(err)
 
 		log.Println("initiating key derivation")
@@ -473,18 +839,55 @@ func main() {
 		log_init()
 
 		log.Println("listening on:", listener.Addr())
+		log.Println("remoteaddr:", config.RemoteAddr)
+		log.Println("probe:", config.Probe)
+		log.Println("acceptproxy:", config.AcceptProxy)
+		log.Println("streamhdr:", config.StreamHdr)
+		if config.AcceptProxy && !config.StreamHdr {
+			log.Println("acceptproxy: original client addresses won't reach the server without --streamhdr")
+		}
+		if config.HalfClose && !config.StreamHdr {
+			log.Println("halfclose: disabled, propagating half-closes requires --streamhdr")
+			config.HalfClose = false
+		}
+		log.Println("halfclose:", config.HalfClose)
+		if len(config.User) > 255 {
+			checkError(errors.New("user: name longer than 255 bytes"))
+		}
+		if config.User != "" && !config.StreamHdr {
+			log.Println("user: ignored, sending a user requires --streamhdr")
+		}
+		log.Println("user:", config.User)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
+		log.Println("cc:", config.CC)
+		log.Println("ccbandwidth:", config.CCBandwidth)
+		log.Println("pacing:", config.Pacing)
 		log.Println("compression:", !config.NoComp)
 		log.Println("mtu:", config.MTU)
+		log.Println("pmtud:", config.PMTUD)
 		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
+		log.Println("adaptivefec:", config.AdaptiveFEC)
+		log.Println("minparity:", config.MinParity)
+		log.Println("maxparity:", config.MaxParity)
 		log.Println("acknodelay:", config.AckNodelay)
 		log.Println("dscp:", config.DSCP)
 		log.Println("sockbuf:", config.SockBuf)
 		log.Println("keepalive:", config.KeepAlive)
 		log.Println("conn:", config.Conn)
+		log.Println("maxconn:", config.MaxConn)
+		log.Println("scalestreams:", config.ScaleStreams, "scalebps:", config.ScaleBps, "scaleidle:", config.ScaleIdle)
+		log.Println("sessionlb:", config.SessionLB)
+		log.Println("connwait:", config.ConnWait, "connqueue:", config.ConnQueue)
 		log.Println("autoexpire:", config.AutoExpire)
 		log.Println("scavengettl:", config.ScavengeTTL)
+		log.Println("draingrace:", config.DrainGrace)
+		log.Println("closewait:", config.CloseWait)
+		log.Println("streamidle:", config.StreamIdle)
+		log.Println("streamlife:", config.StreamLife)
+		log.Println("ratelimit:", config.RateLimit)
+		log.Println("sessionrate:", config.SessionRate)
+		log.Println("streamrate:", config.StreamRate)
 		log.Println("snmplog:", config.SnmpLog)
 		log.Println("snmpperiod:", config.SnmpPeriod)
 		log.Println("quiet:", config.Quiet)
@@ -496,19 +899,69 @@ func main() {
 		smuxConfig.MaxReceiveBuffer = config.SockBuf
 		smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
 
-		createConn := func() (*smux.Session, error) {
-			kcpconn, err := DialKCP(config.RemoteAddr, block, config.DataShard, config.ParityShard)
+		if config.AdaptiveFEC {
+			fecTotals = new(generic.FECCounters)
+		}
+		if newCC != nil {
+			paceTotals = generic.NewPaceStats()
+		}
+		// an address listed twice with different profiles is tuned by each
+		tunings := make(map[*remote]*remoteTuning)
+		for _, r := range remotes.remotes {
+			rt, err := newRemoteTuning(config, r.profile, mode.Auto)
+			checkError(err)
+			tunings[r] = rt
+			if r.profile != "" {
+				log.Println("remote:", r.addr, "profile:", r.profile)
+			}
+		}
+
+		createConn := func(r *remote) (*tunnel, error) {
+			addr, rt := r.addr, tunings[r]
+			var pm *generic.PMTUConn
+			var pc *generic.PaceConn
+			var fc *generic.FECConn
+			var wrapped net.PacketConn
+			var wrap func(net.PacketConn) net.PacketConn
+			if config.PMTUD || newCC != nil || rt.fec != nil {
+				wrap = func(conn net.PacketConn) net.PacketConn {
+					if config.PMTUD {
+						pm = generic.NewPMTUConn(conn)
+						conn = pm
+					}
+					if newCC != nil {
+						pc = generic.NewPaceConn(conn, paceTotals)
+						conn = pc
+					}
+					if rt.fec != nil {
+						fc = generic.NewFECConn(conn, *rt.fec)
+						conn = fc
+					}
+					wrapped = conn
+					return conn
+				}
+			}
+			kcpconn, sock, err := DialKCP(addr, block, rt.dataShards, rt.parityShards, wrap)
 			if err != nil {
 				return nil, errors.Wrap(err, "createConn()")
 			}
+			var conn net.Conn = kcpconn
+			if sock != nil {
+				conn = &kcpConn{kcpconn, sock}
+			}
 			kcpconn.SetStreamMode(true)
 			kcpconn.SetWriteDelay(false)
-			kcpconn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-			kcpconn.SetWindowSize(config.SndWnd, config.RcvWnd)
-			kcpconn.SetMtu(config.MTU)
-			kcpconn.SetACKNoDelay(config.AckNodelay)
+			kcpconn.SetNoDelay(rt.NoDelay, rt.Interval, rt.Resend, rt.NoCongestion)
+			kcpconn.SetWindowSize(rt.SndWnd, rt.RcvWnd)
+			kcpconn.SetMtu(rt.mtu)
+			kcpconn.SetACKNoDelay(rt.AckNodelay)
 
-			if err := kcpconn.SetDSCP(config.DSCP); err != nil {
+			// kcp can't set the DSCP through the wrappers of its socket
+			setDSCP := kcpconn.SetDSCP
+			if wrapped != nil {
+				setDSCP = func(dscp int) error { return generic.SetDSCP(wrapped, dscp) }
+			}
+			if err := setDSCP(config.DSCP); err != nil {
 				log.Println("SetDSCP:", err)
 			}
 			if err := kcpconn.SetReadBuffer(config.SockBuf); err != nil {
@@ -521,70 +974,104 @@ func main() {
 			// stream multiplex
 			var session *smux.Session
 			if config.NoComp {
-				session, err = smux.Client(kcpconn, smuxConfig)
+				session, err = smux.Client(conn, smuxConfig)
 			} else {
-				session, err = smux.Client(newCompStream(kcpconn), smuxConfig)
+				session, err = smux.Client(newCompStream(conn), smuxConfig)
 			}
 			if err != nil {
+				conn.Close()
 				return nil, errors.Wrap(err, "createConn()")
 			}
-			log.Println("connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr())
-			return session, nil
-		}
-
-		// wait until a connection is ready
-		waitConn := func() *smux.Session {
-			for {
-				if session, err := createConn(); err == nil {
-					return session
-				} else {
-					log.Println("re-connecting:", err)
-					time.Sleep(time.Second)
+			log.Println("connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr(), "conv:", kcpconn.GetConv())
+			t := &tunnel{session: session, kcpconn: kcpconn, fins: generic.NewFinTable(), bucket: rl.newSessionBucket()}
+			if rt.auto {
+				// the loss of the session is measured by the adaptive FEC,
+				// or else estimated by the probes of its remote
+				var loss func() float64
+				if fc != nil {
+					raddr := kcpconn.RemoteAddr()
+					loss = func() float64 { return fc.Loss(raddr) }
+				} else if config.Probe > 0 && len(remotes.remotes) > 1 {
+					loss = func() float64 { _, loss := r.stats(); return loss }
 				}
+				tuner := generic.NewAutoTuner(kcpconn, generic.KCPProfile{NoDelay: rt.NoDelay, Interval: rt.Interval, Resend: rt.Resend, NoCongestion: rt.NoCongestion, SndWnd: rt.SndWnd, RcvWnd: rt.RcvWnd}, config.CC != "kcp", loss)
+				go tuner.Run(session.IsClosed)
+			}
+			if pm != nil {
+				go pm.Run(kcpconn, rt.mtu, rt.MTU-rt.mtu, session.IsClosed)
+			}
+			if pc != nil {
+				go pc.Control(kcpconn, newCC(rt.mtu, rt.SndWnd), rt.RcvWnd, session.IsClosed)
+			}
+			if config.HalfClose {
+				go acceptFins(t)
 			}
+			return t, nil
 		}
 
-		numconn := uint16(config.Conn)
-		muxes := make([]struct {
-			session *smux.Session
-			ttl     time.Time
-		}, numconn)
+		go remotes.prober(config.Probe, createConn, config.StreamHdr)
 
-		for k := range muxes {
-			muxes[k].session = waitConn()
-			muxes[k].ttl = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
-		}
-
-		chScavenger := make(chan *smux.Session, 128)
-		go scavenger(chScavenger, config.ScavengeTTL)
+		chScavenger := make(chan *tunnel, 128)
+		go scavenger(chScavenger, config.ScavengeTTL, config.DrainGrace, config.StreamHdr)
 		go snmpLogger(config.SnmpLog, config.SnmpPeriod)
 		go parentMonitor(3)
-		rr := uint16(0)
+
+		pool, err := newSessionPool(config.Conn, createConn, remotes, chScavenger,
+			time.Duration(config.AutoExpire)*time.Second, config.ConnQueue, config.StreamHdr, config.SessionLB)
+		checkError(err)
+		statsPool = pool
+		go pool.autoscale(config.Conn, config.MaxConn, config.ScaleStreams, config.ScaleBps,
+			time.Duration(config.ScaleIdle)*time.Second)
+		// on SIGTERM, stop accepting and wait for the streams to finish
+		g := newGraceful()
+		notifyShutdown(func() {
+			g.shutdown()
+			listener.Close()
+		})
+
 		for {
-			p1, err := listener.AcceptTCP()
+			p1, err := listener.Accept()
 			if err != nil {
+				select {
+				case <-g.die:
+					log.Println("waiting for streams to finish:", g.inflight())
+					drained := g.wait(time.Duration(config.CloseWait) * time.Second)
+					pool.close(config.StreamHdr)
+					if !drained {
+						log.Println("shutdown deadline reached, streams left:", g.inflight())
+						os.Exit(1)
+					}
+					log.Println("all streams finished")
+					os.Exit(0)
+				default:
+				}
 				log.Fatalln(err)
 			}
 			checkError(err)
-			idx := rr % numconn
 
-			// do auto expiration && reconnection
-			if muxes[idx].session.IsClosed() || (config.AutoExpire > 0 && time.Now().After(muxes[idx].ttl)) {
-				chScavenger <- muxes[idx].session
-				muxes[idx].session = waitConn()
-				muxes[idx].ttl = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
-			}
+			go func() {
+				if !g.add() {
+					p1.Close()
+					return
+				}
+				defer g.done()
 
-			go handleClient(muxes[idx].session, p1, config.Quiet)
-			rr++
+				t, err := pool.get(time.Duration(config.ConnWait) * time.Second)
+				if err != nil {
+					log.Println(err)
+					p1.Close()
+					return
+				}
+				handleClient(t, p1, rl, &config)
+			}()
 		}
 	}
 	myApp.Run(os.Args)
 }
 
 type scavengeSession struct {
-	session *smux.Session
-	ts      time.Time
+	tunnel *tunnel
+	ts     time.Time
 }
 
 const (
@@ -606,25 +1093,37 @@ func parentMonitor(interval int) {
 	}
 }
 
-func scavenger(ch chan *smux.Session, ttl int) {
+// scavenger closes expired sessions once their streams are done. An expired
+// session is out of the pool, so it drains from the start: no new streams
+// are placed on it and, with notify set, the server is told so. It is closed
+// anyway once it is ttl seconds old, or grace seconds with streams left,
+// whichever comes first, a negative ttl or a zero grace disabling either.
+func scavenger(ch chan *tunnel, ttl int, grace int, notify bool) {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 	var sessionList []scavengeSession
 	for {
 		select {
-		case sess := <-ch:
-			sessionList = append(sessionList, scavengeSession{sess, time.Now()})
-			log.Println("session marked as expired")
+		case t := <-ch:
+			sessionList = append(sessionList, scavengeSession{tunnel: t, ts: time.Now()})
+			log.Println("session marked as expired, draining", "conv:", t.conv(), "streams:", t.session.NumStreams())
+			if notify && !t.session.IsClosed() {
+				go drain(t)
+			}
 		case <-ticker.C:
 			var newList []scavengeSession
 			for k := range sessionList {
-				s := sessionList[k]
-				if s.session.NumStreams() == 0 || s.session.IsClosed() {
-					log.Println("session normally closed")
-					s.session.Close()
-				} else if ttl >= 0 && time.Since(s.ts) >= time.Duration(ttl)*time.Second {
-					log.Println("session reached scavenge ttl")
-					s.session.Close()
+				s := &sessionList[k]
+				age := time.Since(s.ts)
+				if s.tunnel.session.NumStreams() == 0 || s.tunnel.session.IsClosed() {
+					log.Println("session normally closed", "conv:", s.tunnel.conv())
+					s.tunnel.session.Close()
+				} else if ttl >= 0 && age >= time.Duration(ttl)*time.Second {
+					log.Println("session reached scavenge ttl", "conv:", s.tunnel.conv(), "streams:", s.tunnel.session.NumStreams())
+					s.tunnel.session.Close()
+				} else if grace > 0 && age >= time.Duration(grace)*time.Second {
+					log.Println("session reached drain grace", "conv:", s.tunnel.conv(), "streams:", s.tunnel.session.NumStreams())
+					s.tunnel.session.Close()
 				} else {
 					newList = append(newList, sessionList[k])
 				}
@@ -634,6 +1133,19 @@ func scavenger(ch chan *smux.Session, ttl int) {
 	}
 }
 
+// drain tells the server that no new streams will be opened on the session
+func drain(t *tunnel) {
+	stream, err := t.session.OpenStream()
+	if err != nil {
+		log.Println("drain:", err)
+		return
+	}
+	defer stream.Close()
+	if err := writeCommand(stream, cmdDrain); err != nil {
+		log.Println("drain:", err)
+	}
+}
+
 func snmpLogger(path string, interval int) {
 	if path == "" || interval == 0 {
 		return
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/kcptun/generic"
+	"github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+const (
+	backoffMin    = 500 * time.Millisecond // first reconnection delay
+	backoffMax    = 30 * time.Second       // upper bound of reconnection delay
+	scaleInterval = 5 * time.Second        // how often the pool size is reconsidered
+)
+
+var (
+	errNoSession = errors.New("no session available")
+	errQueueFull = errors.New("too many connections waiting for a session")
+)
+
+// tunnel is a smux session over a kcp connection to a remote
+type tunnel struct {
+	session *smux.Session
+	kcpconn *kcp.UDPSession
+	remote  *remote
+	fins    *generic.FinTable
+	bucket  *bucket // rate limit of the session
+
+	pending int64 // bytes being written into streams, accessed atomically
+	placed  int64 // streams placed on this tunnel, accessed atomically
+	bytes   int64 // bytes relayed in both directions, accessed atomically
+}
+
+// conv identifies the tunnel in logs
+func (t *tunnel) conv() uint32 { return t.kcpconn.GetConv() }
+
+// acceptFins handles the half-closes sent by the server, the only
+// streams a server opens.
+func acceptFins(t *tunnel) {
+	for {
+		s, err := t.session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer s.Close()
+			s.SetReadDeadline(time.Now().Add(hdrTimeout))
+			id, err := readFin(s)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			t.fins.Fin(id)
+		}()
+	}
+}
+
+// tunnelWriter accounts bytes relayed through a tunnel, for writes to a
+// stream it also counts bytes blocked in the write, which is the depth of
+// the send queue in front of the kcp connection.
+type tunnelWriter struct {
+	io.Writer
+	t      *tunnel
+	stream bool
+}
+
+func (w *tunnelWriter) Write(p []byte) (int, error) {
+	if w.stream {
+		atomic.AddInt64(&w.t.pending, int64(len(p)))
+		defer atomic.AddInt64(&w.t.pending, -int64(len(p)))
+	}
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(&w.t.bytes, int64(n))
+	return n, err
+}
+
+// poolSlot holds one of the tunnels of a sessionPool
+type poolSlot struct {
+	tunnel       *tunnel // nil while reconnecting
+	ttl          time.Time
+	reconnecting bool
+
+	lastBytes int64     // tunnel bytes at the last scaling check
+	idleSince time.Time // zero while the tunnel is in use
+}
+
+// sessionPool keeps sessions to the remotes, dead or expired sessions are
+// replaced in background, so accepting local connections never blocks on
+// a reconnection. The number of sessions scales between a minimum and a
+// maximum following the load.
+type sessionPool struct {
+	createConn  func(r *remote) (*tunnel, error)
+	remotes     *remoteSet
+	chScavenger chan *tunnel
+	autoExpire  time.Duration
+	maxQueue    int
+	verify      bool   // ping new sessions before use, requires --streamhdr
+	strategy    string // rr, leaststreams, rtt, sendqueue
+
+	mu      sync.Mutex
+	slots   []*poolSlot
+	rr      int
+	waiting int
+	ready   chan struct{} // closed when a session becomes available
+	closed  bool
+}
+
+func newSessionPool(numconn int, createConn func(r *remote) (*tunnel, error), remotes *remoteSet, chScavenger chan *tunnel, autoExpire time.Duration, maxQueue int, verify bool, strategy string) (*sessionPool, error) {
+	switch strategy {
+	case "rr", "leaststreams", "rtt", "sendqueue":
+	default:
+		return nil, errors.Errorf("newSessionPool: unknown strategy %v", strategy)
+	}
+
+	p := new(sessionPool)
+	p.createConn = createConn
+	p.remotes = remotes
+	p.chScavenger = chScavenger
+	p.autoExpire = autoExpire
+	p.maxQueue = maxQueue
+	p.verify = verify
+	p.strategy = strategy
+	p.ready = make(chan struct{})
+	p.slots = make([]*poolSlot, numconn)
+
+	p.mu.Lock()
+	for k := range p.slots {
+		p.slots[k] = new(poolSlot)
+		p.reconnect(k)
+	}
+	p.mu.Unlock()
+	return p, nil
+}
+
+// get returns a healthy tunnel, waiting at most timeout for one to come up
+func (p *sessionPool) get(timeout time.Duration) (*tunnel, error) {
+	p.mu.Lock()
+	t, retired := p.pick()
+	if t != nil {
+		p.mu.Unlock()
+		p.scavenge(retired)
+		return t, nil
+	}
+	if p.waiting >= p.maxQueue {
+		p.mu.Unlock()
+		p.scavenge(retired)
+		return nil, errQueueFull
+	}
+	p.waiting++
+	defer func() { p.scavenge(retired) }()
+	defer func() {
+		p.mu.Lock()
+		p.waiting--
+		p.mu.Unlock()
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		ready := p.ready
+		p.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-deadline.C:
+			return nil, errNoSession
+		}
+
+		p.mu.Lock()
+		t, r := p.pick()
+		retired = append(retired, r...)
+		if t != nil {
+			p.mu.Unlock()
+			return t, nil
+		}
+	}
+}
+
+// pick retires unusable tunnels and returns the best healthy one by the
+// strategy, ties are broken in round-robin order, the caller must hold p.mu
+// and hand the retired tunnels to scavenge once it is released.
+func (p *sessionPool) pick() (best *tunnel, retired []*tunnel) {
+	if p.closed {
+		return nil, nil
+	}
+	var bestIdx int
+	var bestLoad int64
+	for i := 0; i < len(p.slots); i++ {
+		idx := (p.rr + i) % len(p.slots)
+		slot := p.slots[idx]
+		t := slot.tunnel
+		if t == nil {
+			continue
+		}
+
+		// do auto expiration && reconnection, sessions to a remote
+		// which went down are moved to another remote
+		var reason string
+		if t.session.IsClosed() {
+			t.remote.fail()
+			reason = "closed"
+		} else if t.remote.isDown() && p.remotes.anyUp() {
+			reason = "remote down"
+		} else if p.autoExpire > 0 && time.Now().After(slot.ttl) {
+			reason = "expired"
+		}
+		if reason != "" {
+			log.Println("session rotating", "conv:", t.conv(), "reason:", reason)
+			retired = append(retired, t)
+			slot.tunnel = nil
+			p.reconnect(idx)
+			continue
+		}
+
+		var load int64
+		switch p.strategy {
+		case "leaststreams":
+			load = int64(t.session.NumStreams())
+		case "rtt":
+			load = int64(t.kcpconn.GetSRTT())
+		case "sendqueue":
+			load = atomic.LoadInt64(&t.pending)
+		}
+		if best == nil || load < bestLoad {
+			best, bestIdx, bestLoad = t, idx, load
+		}
+		if p.strategy == "rr" {
+			break
+		}
+	}
+
+	if best != nil {
+		p.rr = bestIdx + 1
+		atomic.AddInt64(&best.placed, 1)
+	}
+	return best, retired
+}
+
+// scavenge hands retired tunnels over to the scavenger, without holding p.mu
+// as the scavenger may be slow to receive.
+func (p *sessionPool) scavenge(retired []*tunnel) {
+	for _, t := range retired {
+		p.chScavenger <- t
+	}
+}
+
+// reconnect replaces the tunnel in slot idx in background, retrying with
+// exponential backoff and jitter, the caller must hold p.mu.
+func (p *sessionPool) reconnect(idx int) {
+	slot := p.slots[idx]
+	if slot.reconnecting {
+		return
+	}
+	slot.reconnecting = true
+
+	go func() {
+		backoff := backoffMin
+		for {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return
+			}
+
+			r := p.remotes.pick()
+			t, err := p.createConn(r)
+			if err == nil && p.verify {
+				// a kcp dial always succeeds, make sure the server answers
+				if _, err = ping(t.session); err != nil {
+					t.session.Close()
+				}
+			}
+			if err == nil {
+				t.remote = r
+				p.mu.Lock()
+				if p.closed {
+					p.mu.Unlock()
+					t.session.Close()
+					return
+				}
+				slot.tunnel = t
+				slot.ttl = time.Now().Add(p.autoExpire)
+				slot.reconnecting = false
+				slot.lastBytes = 0
+				slot.idleSince = time.Time{}
+				close(p.ready)
+				p.ready = make(chan struct{})
+				p.mu.Unlock()
+				return
+			}
+
+			r.fail()
+			// jitter in [backoff/2, backoff)
+			delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+			log.Println("re-connecting:", err, "retry in", delay)
+			time.Sleep(delay)
+			if backoff *= 2; backoff > backoffMax {
+				backoff = backoffMax
+			}
+		}
+	}()
+}
+
+// autoscale adds a session when the average streams or throughput(bytes
+// per second) per session reach the thresholds, up to maxConn sessions, and
+// hands sessions idle for longer than idle over to the scavenger, down to
+// minConn sessions.
+func (p *sessionPool) autoscale(minConn, maxConn, streams, bps int, idle time.Duration) {
+	if maxConn <= minConn {
+		return
+	}
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var retired []*tunnel
+		p.mu.Lock()
+		now := time.Now()
+		var active, totalStreams int
+		var totalBytes int64
+		for _, slot := range p.slots {
+			t := slot.tunnel
+			if t == nil {
+				continue
+			}
+			bytes := atomic.LoadInt64(&t.bytes)
+			delta := bytes - slot.lastBytes
+			slot.lastBytes = bytes
+
+			n := t.session.NumStreams()
+			if n == 0 && delta == 0 {
+				if slot.idleSince.IsZero() {
+					slot.idleSince = now
+				}
+			} else {
+				slot.idleSince = time.Time{}
+			}
+			active++
+			totalStreams += n
+			totalBytes += delta
+		}
+
+		// only grow when every session is up
+		if active > 0 && active == len(p.slots) && len(p.slots) < maxConn {
+			avgStreams := totalStreams / active
+			avgBps := totalBytes / int64(active) / int64(scaleInterval/time.Second)
+			if (streams > 0 && avgStreams >= streams) || (bps > 0 && avgBps >= int64(bps)) {
+				p.slots = append(p.slots, new(poolSlot))
+				p.reconnect(len(p.slots) - 1)
+				log.Println("pool scaled up:", len(p.slots), "streams:", avgStreams, "bps:", avgBps)
+				p.mu.Unlock()
+				continue
+			}
+		}
+
+		// shrink by one idle session at a time
+		if len(p.slots) > minConn {
+			for k, slot := range p.slots {
+				if slot.tunnel != nil && !slot.idleSince.IsZero() && now.Sub(slot.idleSince) >= idle {
+					retired = append(retired, slot.tunnel)
+					p.slots = append(p.slots[:k], p.slots[k+1:]...)
+					log.Println("pool scaled down:", len(p.slots))
+					break
+				}
+			}
+		}
+		p.mu.Unlock()
+		p.scavenge(retired)
+	}
+}
+
+// close closes every session of the pool, with notify set the server is
+// told about it first, so it can release the session right away.
+func (p *sessionPool) close(notify bool) {
+	p.mu.Lock()
+	p.closed = true
+	slots := p.slots
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, slot := range slots {
+		if t := slot.tunnel; t != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if notify && !t.session.IsClosed() {
+					drain(t)
+				}
+				t.session.Close()
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// logStats prints the load of every tunnel in the pool
+func (p *sessionPool) logStats() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, slot := range p.slots {
+		t := slot.tunnel
+		if t == nil {
+			log.Printf("session %v: reconnecting", k)
+			continue
+		}
+		log.Printf("session %v: conv:%v remote:%v streams:%v placed:%v srtt:%vms sendqueue:%v",
+			k, t.conv(), t.remote.addr, t.session.NumStreams(), atomic.LoadInt64(&t.placed),
+			t.kcpconn.GetSRTT(), atomic.LoadInt64(&t.pending))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/kcptun/generic"
+)
+
+// PROXY protocol, see: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyV1MaxLen   = 107              // max length of a v1 header line, including CRLF
+	proxyV2HdrLen   = 16               // fixed part of a v2 header
+	proxyHdrTimeout = 10 * time.Second // max time to wait for the header
+)
+
+// proxyConn is a connection accepted from a PROXY protocol speaking peer,
+// reporting the addresses carried in the header.
+type proxyConn struct {
+	net.Conn
+	r     *bufio.Reader
+	raddr net.Addr
+	laddr net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.raddr }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.laddr }
+func (c *proxyConn) CloseWrite() error          { return generic.CloseWrite(c.Conn) }
+
+// acceptProxyHeader consumes a PROXY v1 or v2 header from conn, connections
+// without a valid header are rejected.
+func acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	pc := &proxyConn{Conn: conn, r: bufio.NewReader(conn), raddr: conn.RemoteAddr(), laddr: conn.LocalAddr()}
+	conn.SetReadDeadline(time.Now().Add(proxyHdrTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	b, err := pc.r.Peek(1)
+	if err != nil {
+		return nil, errors.Wrap(err, "acceptProxyHeader")
+	}
+	switch b[0] {
+	case 'P':
+		err = pc.readV1()
+	case proxyV2Signature[0]:
+		err = pc.readV2()
+	default:
+		err = errors.New("acceptProxyHeader: missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return errors.Wrap(err, "readV1")
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("readV1: header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return errors.New("readV1: malformed header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errors.New("readV1: malformed header")
+	}
+
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.raddr, c.laddr = src, dst
+	return nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.Errorf("readV1: invalid address %v", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Errorf("readV1: invalid port %v", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func (c *proxyConn) readV2() error {
+	var hdr [proxyV2HdrLen]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return errors.Wrap(err, "readV2")
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) || hdr[12]>>4 != 2 {
+		return errors.New("readV2: malformed header")
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return errors.Wrap(err, "readV2")
+	}
+
+	// LOCAL command, the connection was made by the proxy itself
+	if hdr[12]&0xF == 0 {
+		return nil
+	}
+
+	var iplen int
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		iplen = net.IPv4len
+	case 2: // AF_INET6
+		iplen = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX
+		return nil
+	}
+	if len(payload) < 2*iplen+4 {
+		return errors.New("readV2: short address block")
+	}
+
+	src := &net.TCPAddr{IP: net.IP(payload[:iplen]), Port: int(binary.BigEndian.Uint16(payload[2*iplen:]))}
+	dst := &net.TCPAddr{IP: net.IP(payload[iplen : 2*iplen]), Port: int(binary.BigEndian.Uint16(payload[2*iplen+2:]))}
+	c.raddr, c.laddr = src, dst
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bucket is a token bucket of bytes, its rate is shared by every bucket of
+// the same scope so it can be changed at runtime, a rate of 0 is unlimited.
+type bucket struct {
+	rate      *int64 // bytes per second, accessed atomically
+	throttled *int64 // nanoseconds writes were delayed in the scope, accessed atomically
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate, throttled *int64) *bucket {
+	return &bucket{rate: rate, throttled: throttled, last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket, returning how long to wait for
+// them, a bucket holds at most one second worth of bytes.
+func (b *bucket) reserve(n int) time.Duration {
+	rate := atomic.LoadInt64(b.rate)
+	if rate <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// limitWriter delays writes to keep within the rates of its buckets
+type limitWriter struct {
+	io.Writer
+	buckets []*bucket
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	var delay time.Duration
+	for _, b := range w.buckets {
+		if d := b.reserve(len(p)); d > 0 {
+			atomic.AddInt64(b.throttled, int64(d))
+			if d > delay {
+				delay = d
+			}
+		}
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return w.Writer.Write(p)
+}
+
+// rateLimits are the bandwidth limits in bytes per second, global, per
+// session and per stream, counting both directions.
+type rateLimits struct {
+	global, session, stream int64 // accessed atomically
+
+	// throttled time per scope in nanoseconds, accessed atomically
+	globalThrottled, sessionThrottled, streamThrottled int64
+
+	globalBucket *bucket
+	path         string // config file the rates are reloaded from
+}
+
+func newRateLimits(global, session, stream int) *rateLimits {
+	rl := new(rateLimits)
+	rl.set(global, session, stream)
+	rl.globalBucket = newBucket(&rl.global, &rl.globalThrottled)
+	return rl
+}
+
+// set changes the rates, existing sessions and streams included
+func (rl *rateLimits) set(global, session, stream int) {
+	atomic.StoreInt64(&rl.global, int64(global))
+	atomic.StoreInt64(&rl.session, int64(session))
+	atomic.StoreInt64(&rl.stream, int64(stream))
+}
+
+func (rl *rateLimits) newSessionBucket() *bucket {
+	return newBucket(&rl.session, &rl.sessionThrottled)
+}
+
+func (rl *rateLimits) newStreamBucket() *bucket {
+	return newBucket(&rl.stream, &rl.streamThrottled)
+}
+
+// writer limits the writes to w by the global bucket and the given ones
+func (rl *rateLimits) writer(w io.Writer, buckets ...*bucket) io.Writer {
+	return &limitWriter{Writer: w, buckets: append([]*bucket{rl.globalBucket}, buckets...)}
+}
+
+// reload reads the rates from the config file, rates missing from the
+// file are left unchanged.
+func (rl *rateLimits) reload() {
+	if rl.path == "" {
+		log.Println("ratelimit: no config file to reload")
+		return
+	}
+	config := Config{
+		RateLimit:   int(atomic.LoadInt64(&rl.global)),
+		SessionRate: int(atomic.LoadInt64(&rl.session)),
+		StreamRate:  int(atomic.LoadInt64(&rl.stream)),
+	}
+	if err := parseJSONConfig(&config, rl.path); err != nil {
+		log.Println("ratelimit: reload:", err)
+		return
+	}
+	rl.set(config.RateLimit, config.SessionRate, config.StreamRate)
+	log.Println("ratelimit:", config.RateLimit, "sessionrate:", config.SessionRate, "streamrate:", config.StreamRate)
+}
+
+// logStats prints the time writes were throttled in every scope
+func (rl *rateLimits) logStats() {
+	log.Printf("throttled: global:%v session:%v stream:%v",
+		time.Duration(atomic.LoadInt64(&rl.globalThrottled)),
+		time.Duration(atomic.LoadInt64(&rl.sessionThrottled)),
+		time.Duration(atomic.LoadInt64(&rl.streamThrottled)))
+}
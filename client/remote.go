@@ -0,0 +1,298 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/kcptun/generic"
+	"github.com/xtaci/smux"
+)
+
+const (
+	remoteMaxFails = 3                // consecutive failures before a remote is marked down
+	remoteDownTime = 30 * time.Second // how long a remote stays down without a successful probe
+	probeTimeout   = 3 * time.Second  // max time to wait for a pong
+)
+
+// remote is a kcp server the client can connect to, a remote address is
+// written as host:port[/priority[/weight[/profile]]], the lowest priority
+// value is preferred, remotes with the same priority share sessions by
+// weight, sessions to a remote with a profile are tuned by it instead of
+// --mode.
+type remote struct {
+	addr     string
+	priority int
+	weight   int
+	profile  string
+
+	mu        sync.Mutex
+	rtt       time.Duration // smoothed probe rtt
+	loss      float64       // smoothed probe loss rate
+	fails     int           // consecutive failures
+	downUntil time.Time
+}
+
+// parseRemotes parses a comma separated list of remote servers
+func parseRemotes(s string) ([]*remote, error) {
+	var remotes []*remote
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, "/")
+		if len(parts) > 4 {
+			return nil, errors.Errorf("parseRemotes: malformed remote %v", item)
+		}
+		r := &remote{addr: parts[0], weight: 1}
+		var err error
+		if len(parts) > 1 {
+			if r.priority, err = strconv.Atoi(parts[1]); err != nil {
+				return nil, errors.Wrap(err, "parseRemotes: priority")
+			}
+		}
+		if len(parts) > 2 {
+			if r.weight, err = strconv.Atoi(parts[2]); err != nil || r.weight <= 0 {
+				return nil, errors.Errorf("parseRemotes: invalid weight in %v", item)
+			}
+		}
+		if len(parts) > 3 {
+			r.profile = parts[3]
+		}
+		remotes = append(remotes, r)
+	}
+	if len(remotes) == 0 {
+		return nil, errors.New("parseRemotes: no remote specified")
+	}
+	return remotes, nil
+}
+
+func (r *remote) isDown() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Now().Before(r.downUntil)
+}
+
+// fail records a failed dial, probe or a dead session
+func (r *remote) fail() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loss = 0.9*r.loss + 0.1
+	r.fails++
+	if r.fails >= remoteMaxFails && !time.Now().Before(r.downUntil) {
+		r.downUntil = time.Now().Add(remoteDownTime)
+		log.Println("remote down:", r.addr)
+	}
+}
+
+// succeed records a successful probe
+func (r *remote) succeed(rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rtt == 0 {
+		r.rtt = rtt
+	} else {
+		r.rtt = (7*r.rtt + rtt) / 8
+	}
+	r.loss = 0.9 * r.loss
+	r.fails = 0
+	if time.Now().Before(r.downUntil) {
+		r.downUntil = time.Time{}
+		log.Println("remote up:", r.addr)
+	}
+}
+
+// health scales the weight of a remote by its probe results, a remote
+// with higher rtt or loss than its peers gets proportionally fewer sessions.
+func (r *remote) health(minRTT time.Duration) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := float64(r.weight) / (1 + 10*r.loss)
+	if r.rtt > 0 && minRTT > 0 {
+		h *= float64(minRTT) / float64(r.rtt)
+	}
+	return h
+}
+
+func (r *remote) stats() (rtt time.Duration, loss float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rtt, r.loss
+}
+
+// remoteTuning is the kcp tuning of the sessions to a remote, the options
+// with the profile of the remote applied.
+type remoteTuning struct {
+	*Config
+	auto                     bool // the sessions are tuned by generic.AutoTuner
+	fec                      *generic.FECParams
+	dataShards, parityShards int // shards of kcp, 0 when handled by the FEC connection
+	mtu                      int // mtu of kcp, less the overhead of the FEC connection
+}
+
+// newRemoteTuning applies profile to config, auto tells whether the
+// sessions of remotes without a profile are tuned.
+func newRemoteTuning(config Config, profile string, auto bool) (*remoteTuning, error) {
+	if profile != "" {
+		p, err := generic.LookupProfile(profile, config.Profiles)
+		if err != nil {
+			return nil, err
+		}
+		p.Apply(config.profileOptions())
+		auto = p.Auto
+	}
+	if config.CC != "kcp" {
+		// the controller replaces the congestion control of kcp
+		config.NoCongestion = 1
+	}
+	rt := &remoteTuning{Config: &config, auto: auto, dataShards: config.DataShard, parityShards: config.ParityShard, mtu: config.MTU}
+	if config.AdaptiveFEC {
+		fec, err := generic.NewFECParams(config.DataShard, config.ParityShard, config.MinParity, config.MaxParity)
+		if err != nil {
+			return nil, err
+		}
+		fec.Stats = fecTotals
+		// the shards are handled by the FEC connection, kcp runs without FEC
+		rt.fec, rt.dataShards, rt.parityShards = fec, 0, 0
+		rt.mtu -= generic.FECOverhead
+	}
+	return rt, nil
+}
+
+// remoteSet selects remotes for new sessions
+type remoteSet struct {
+	remotes []*remote
+}
+
+// anyUp tells whether some remote is available
+func (rs *remoteSet) anyUp() bool {
+	for _, r := range rs.remotes {
+		if !r.isDown() {
+			return true
+		}
+	}
+	return false
+}
+
+// pick chooses a remote among those which are up with the best priority,
+// weighted by their health; when every remote is down, the best priority
+// remote is returned anyway.
+func (rs *remoteSet) pick() *remote {
+	var tier []*remote
+	for _, r := range rs.remotes {
+		if r.isDown() {
+			continue
+		}
+		if len(tier) == 0 || r.priority < tier[0].priority {
+			tier = []*remote{r}
+		} else if r.priority == tier[0].priority {
+			tier = append(tier, r)
+		}
+	}
+	if len(tier) == 0 {
+		best := rs.remotes[0]
+		for _, r := range rs.remotes {
+			if r.priority < best.priority {
+				best = r
+			}
+		}
+		return best
+	}
+
+	var minRTT time.Duration
+	for _, r := range tier {
+		if rtt, _ := r.stats(); rtt > 0 && (minRTT == 0 || rtt < minRTT) {
+			minRTT = rtt
+		}
+	}
+	weights := make([]float64, len(tier))
+	var total float64
+	for k, r := range tier {
+		weights[k] = r.health(minRTT)
+		total += weights[k]
+	}
+	n := rand.Float64() * total
+	for k := range tier {
+		if n -= weights[k]; n < 0 {
+			return tier[k]
+		}
+	}
+	return tier[len(tier)-1]
+}
+
+// prober probes every remote through a dedicated session at the given
+// interval. With withPing, the session is pinged, as servers running with
+// --streamhdr answer; otherwise the kcp rtt of the session, kept alive by
+// smux, is taken, and a remote is failed when its session dies.
+func (rs *remoteSet) prober(interval int, createConn func(r *remote) (*tunnel, error), withPing bool) {
+	if interval <= 0 || len(rs.remotes) < 2 {
+		return
+	}
+	tunnels := make([]*tunnel, len(rs.remotes))
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		var wg sync.WaitGroup
+		for k := range rs.remotes {
+			wg.Add(1)
+			go func(k int) {
+				defer wg.Done()
+				r := rs.remotes[k]
+				if tunnels[k] != nil && tunnels[k].session.IsClosed() {
+					tunnels[k] = nil
+					r.fail()
+					return
+				}
+				if tunnels[k] == nil {
+					t, err := createConn(r)
+					if err != nil {
+						r.fail()
+						return
+					}
+					tunnels[k] = t
+				}
+				if !withPing {
+					if srtt := tunnels[k].kcpconn.GetSRTT(); srtt > 0 {
+						r.succeed(time.Duration(srtt) * time.Millisecond)
+					}
+					return
+				}
+				rtt, err := ping(tunnels[k].session)
+				if err != nil {
+					tunnels[k].session.Close()
+					tunnels[k] = nil
+					r.fail()
+					return
+				}
+				r.succeed(rtt)
+			}(k)
+		}
+		wg.Wait()
+	}
+}
+
+// ping sends a cmdPing stream header and waits for the server to answer
+func ping(sess *smux.Session) (time.Duration, error) {
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return 0, errors.Wrap(err, "ping")
+	}
+	defer stream.Close()
+
+	start := time.Now()
+	stream.SetReadDeadline(start.Add(probeTimeout))
+	if err := writeCommand(stream, cmdPing); err != nil {
+		return 0, err
+	}
+	var pong [1]byte
+	if _, err := io.ReadFull(stream, pong[:]); err != nil {
+		return 0, errors.Wrap(err, "ping")
+	}
+	return time.Since(start), nil
+}
@@ -17,13 +17,29 @@ func init() {
 
 func sigHandler() {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGUSR1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGHUP)
 	signal.Ignore(syscall.SIGPIPE)
 
 	for {
 		switch <-ch {
 		case syscall.SIGUSR1:
 			log.Printf("KCP SNMP:%+v", kcp.DefaultSnmp.Copy())
+			if statsPool != nil {
+				statsPool.logStats()
+			}
+			if limits != nil {
+				limits.logStats()
+			}
+			if fecTotals != nil {
+				fecTotals.LogStats()
+			}
+			if paceTotals != nil {
+				paceTotals.LogStats()
+			}
+		case syscall.SIGHUP:
+			if limits != nil {
+				limits.reload()
+			}
 		}
 	}
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const unixPrefix = "unix:"
+
+// isUnixAddr tells whether addr refers to a unix domain socket, like
+// "unix:/var/run/kcptun.sock", or "unix:@kcptun" for an abstract socket on linux.
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixPrefix)
+}
+
+// listenLocal creates the local listener for tcp or unix addresses
+func listenLocal(config *Config) (net.Listener, error) {
+	if !isUnixAddr(config.LocalAddr) {
+		addr, err := net.ResolveTCPAddr("tcp", config.LocalAddr)
+		if err != nil {
+			return nil, errors.Wrap(err, "net.ResolveTCPAddr")
+		}
+		return net.ListenTCP("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(config.LocalAddr, unixPrefix)
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenUnix")
+	}
+	if abstract {
+		return listener, nil
+	}
+
+	if config.UnixMode != "" {
+		mode, err := strconv.ParseUint(config.UnixMode, 8, 32)
+		if err != nil {
+			listener.Close()
+			return nil, errors.Wrap(err, "unixmode")
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			listener.Close()
+			return nil, errors.Wrap(err, "os.Chmod")
+		}
+	}
+	if config.UnixOwner != "" {
+		uid, gid, err := lookupOwner(config.UnixOwner)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			listener.Close()
+			return nil, errors.Wrap(err, "os.Chown")
+		}
+	}
+	return listener, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run,
+// refusing to touch it if some process is still accepting on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "os.Lstat")
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%v exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return errors.Errorf("%v is in use by another process", path)
+	}
+	log.Println("removing stale socket:", path)
+	return errors.Wrap(os.Remove(path), "os.Remove")
+}
+
+// lookupOwner parses "user[:group]" into numeric ids, -1 leaves the id unchanged
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	name, group := owner, ""
+	if idx := strings.Index(owner, ":"); idx >= 0 {
+		name, group = owner[:idx], owner[idx+1:]
+	}
+
+	if name != "" {
+		if uid, err = strconv.Atoi(name); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return -1, -1, errors.Wrap(err, "user.Lookup")
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return -1, -1, errors.Wrap(err, "uid")
+			}
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return -1, -1, errors.Wrap(err, "user.LookupGroup")
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, errors.Wrap(err, "gid")
+			}
+		}
+	}
+	return uid, gid, nil
+}
@@ -2,10 +2,33 @@
 
 package main
 
-import "github.com/xtaci/kcp-go"
+import (
+    "io"
+    "net"
 
-func DialKCP(raddr string, block kcp.BlockCrypt, dataShards, parityShards int) (*kcp.UDPSession, error) {
-    return kcp.DialWithOptions(raddr, block, dataShards, parityShards)
+    "github.com/pkg/errors"
+    "github.com/xtaci/kcp-go"
+)
+
+// DialKCP connects to raddr, over the connection returned by wrap when not nil,
+// the socket returned must be closed with the session as kcp only closes the
+// sockets it creates, it is nil when kcp created it.
+func DialKCP(raddr string, block kcp.BlockCrypt, dataShards, parityShards int, wrap func(net.PacketConn) net.PacketConn) (*kcp.UDPSession, io.Closer, error) {
+    if wrap == nil {
+        kcpconn, err := kcp.DialWithOptions(raddr, block, dataShards, parityShards)
+        return kcpconn, nil, err
+    }
+
+    udpconn, err := net.ListenUDP("udp", nil)
+    if err != nil {
+        return nil, nil, errors.Wrap(err, "net.ListenUDP")
+    }
+    kcpconn, err := kcp.NewConn(raddr, block, dataShards, parityShards, wrap(udpconn))
+    if err != nil {
+        udpconn.Close()
+        return nil, nil, err
+    }
+    return kcpconn, udpconn, nil
 }
 
 func log_init() {
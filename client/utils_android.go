@@ -67,6 +67,7 @@ set_timeout(int sock)
 import "C"
 
 import (
+    "io"
     "log"
     "net"
 	"syscall"
@@ -126,16 +127,32 @@ type connectedUDPConn struct{ *net.UDPConn }
 // WriteTo redirects all writes to the Write syscall, which is 4 times faster.
 func (c *connectedUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) { return c.Write(b) }
 
-func DialKCP(raddr string, block kcp.BlockCrypt, dataShards, parityShards int) (*kcp.UDPSession, error) {
-    if !VpnMode {
-        return kcp.DialWithOptions(raddr, block, dataShards, parityShards)
+func DialKCP(raddr string, block kcp.BlockCrypt, dataShards, parityShards int, wrap func(net.PacketConn) net.PacketConn) (*kcp.UDPSession, io.Closer, error) {
+    if !VpnMode && wrap == nil {
+        kcpconn, err := kcp.DialWithOptions(raddr, block, dataShards, parityShards)
+        return kcpconn, nil, err
     }
 
-    d := net.Dialer{Control: ControlOnConnSetup}
-	udpconn, err := d.Dial("udp", raddr)
+    var udpconn net.Conn
+    var err error
+    if VpnMode {
+        d := net.Dialer{Control: ControlOnConnSetup}
+        udpconn, err = d.Dial("udp", raddr)
+    } else {
+        udpconn, err = net.Dial("udp", raddr)
+    }
 	if err != nil {
-		return nil, errors.Wrap(err, "net.DialUDP")
+		return nil, nil, errors.Wrap(err, "net.DialUDP")
 	}
 
-	return kcp.NewConn(raddr, block, dataShards, parityShards, &connectedUDPConn{udpconn.(*net.UDPConn)})
+	var conn net.PacketConn = &connectedUDPConn{udpconn.(*net.UDPConn)}
+	if wrap != nil {
+		conn = wrap(conn)
+	}
+	kcpconn, err := kcp.NewConn(raddr, block, dataShards, parityShards, conn)
+	if err != nil {
+		udpconn.Close()
+		return nil, nil, err
+	}
+	return kcpconn, udpconn, nil
 }
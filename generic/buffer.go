@@ -0,0 +1,28 @@
+package generic
+
+import (
+	"io"
+	"sync"
+)
+
+// bufSize is the size of the buffers relaying streams
+const bufSize = 65535
+
+// bufPool recycles the relay buffers, allocating two of them for every
+// stream dominates the garbage collection with many short streams.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, bufSize)
+		return &b
+	},
+}
+
+// CopyBuffer is io.CopyBuffer with a buffer from bufPool. The relays never
+// splice: one end is always a smux stream, and the writers of the limits, the
+// watch and the quota hide the ReaderFrom of the other, so the buffer is
+// always used.
+func CopyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	bp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bp)
+	return io.CopyBuffer(dst, src, *bp)
+}
@@ -0,0 +1,48 @@
+package generic
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// writerOnly hides the ReaderFrom of its writer as the relay writers do
+type writerOnly struct {
+	io.Writer
+}
+
+// readerOnly hides the WriterTo of its reader as a smux stream does
+type readerOnly struct {
+	io.Reader
+}
+
+// a long stream, for the throughput
+func BenchmarkCopyBuffer(b *testing.B) {
+	data := make([]byte, 4<<20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CopyBuffer(writerOnly{ioutil.Discard}, readerOnly{bytes.NewReader(data)})
+	}
+}
+
+// a short stream per iteration, for the allocations of a stream
+func BenchmarkCopyBufferStream(b *testing.B) {
+	data := make([]byte, 4<<10)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		CopyBuffer(writerOnly{ioutil.Discard}, readerOnly{bytes.NewReader(data)})
+	}
+}
+
+// the same with io.Copy allocating a buffer per stream, for comparison
+func BenchmarkIOCopyStream(b *testing.B) {
+	data := make([]byte, 4<<10)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		io.Copy(writerOnly{ioutil.Discard}, readerOnly{bytes.NewReader(data)})
+	}
+}
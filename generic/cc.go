@@ -0,0 +1,241 @@
+package generic
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+const (
+	ccInterval   = 100 * time.Millisecond // how often a controller is fed
+	ccMinWnd     = 16                     // smallest send window in packets
+	ccMinRate    = 16 << 10               // smallest pacing rate in bytes per second
+	bbrBwSamples = 20                     // delivery rate samples kept for the bandwidth estimate
+	bbrRTTWindow = 10 * time.Second       // how long a min rtt sample is valid
+)
+
+// bbrGains is the pacing gain cycle once the bandwidth is found, probing
+// for more bandwidth then draining the queue it built.
+var bbrGains = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// ccSample is what a controller learns of its session in an interval
+type ccSample struct {
+	rtt      time.Duration // smoothed rtt
+	sent     uint64        // bytes sent in the interval
+	interval time.Duration
+	queued   int // packets waiting in the pacer
+}
+
+// Congestion is a congestion controller, replacing the one of kcp, it
+// returns the pacing rate in bytes per second and the send window in
+// packets of its session, 0 to leave the window to kcp.
+type Congestion interface {
+	update(s ccSample) (rate int64, wnd int)
+	close()
+}
+
+// CCFactory creates the controller of a new session
+type CCFactory func(mtu, maxWnd int) Congestion
+
+// NewCCFactory returns the factory of the controllers called name, the
+// fair controller shares bandwidth among the sessions.
+func NewCCFactory(name string, bandwidth int) (CCFactory, error) {
+	switch name {
+	case "bbr":
+		return func(mtu, maxWnd int) Congestion { return newBBR(mtu, maxWnd) }, nil
+	case "fair":
+		if bandwidth <= 0 {
+			return nil, errors.New("newCCFactory: the fair controller requires --ccbandwidth")
+		}
+		share := &fairShare{bandwidth: int64(bandwidth)}
+		return func(mtu, maxWnd int) Congestion {
+			share.add()
+			return &fairController{Congestion: newBBR(mtu, maxWnd), share: share, mtu: mtu}
+		}, nil
+	}
+	return nil, errors.Errorf("newCCFactory: unknown controller %v", name)
+}
+
+// bbr is a delay based controller after BBR, it paces at the bottleneck
+// bandwidth estimated from the delivery rate, and keeps two bandwidth-delay
+// products in flight.
+type bbr struct {
+	mtu, maxWnd int
+
+	samples  [bbrBwSamples]float64
+	next     int
+	btlBw    float64 // bytes per second
+	minRTT   time.Duration
+	minRTTAt time.Time
+
+	startup bool
+	plateau int     // startup rounds without bandwidth growth
+	lastBw  float64 // bandwidth at the last growth
+	cycle   int
+	rate    float64
+}
+
+func newBBR(mtu, maxWnd int) *bbr {
+	return &bbr{mtu: mtu, maxWnd: maxWnd, startup: true}
+}
+
+func (b *bbr) update(s ccSample) (int64, int) {
+	now := time.Now()
+	if b.minRTT == 0 || s.rtt <= b.minRTT || now.Sub(b.minRTTAt) > bbrRTTWindow {
+		b.minRTT, b.minRTTAt = s.rtt, now
+	}
+
+	// the acks are not visible outside kcp, the delivery rate is the rate
+	// packets leave the pacer, less the share of the rtt spent queued on
+	// the path (Little's law: rate = inflight / rtt). A sample limited by
+	// the application, not the path, only counts when it raises the
+	// estimate.
+	delivered := float64(s.sent) / s.interval.Seconds() * math.Min(1, float64(b.minRTT)/float64(s.rtt))
+	appLimited := s.queued == 0 && delivered < 0.8*b.rate
+	if !appLimited || delivered > b.btlBw {
+		b.samples[b.next] = delivered
+		b.next = (b.next + 1) % len(b.samples)
+	}
+	b.btlBw = 0
+	for _, v := range b.samples {
+		b.btlBw = math.Max(b.btlBw, v)
+	}
+
+	if b.startup {
+		// grow the rate each round until the bandwidth stops growing or a
+		// queue builds, rounds without enough data to send don't tell
+		if !appLimited {
+			if b.btlBw > 1.25*b.lastBw {
+				b.lastBw, b.plateau = b.btlBw, 0
+			} else if b.plateau++; b.plateau >= 3 {
+				b.startup = false
+			}
+			if s.rtt > b.minRTT*3/2 {
+				b.startup = false
+			}
+		}
+		b.rate = math.Max(2.89*b.btlBw, b.rate)
+	} else {
+		gain := bbrGains[b.cycle%len(bbrGains)]
+		b.cycle++
+		if s.rtt > b.minRTT*3/2 {
+			// a queue is building, drain it
+			gain = math.Min(gain, 0.75)
+		}
+		b.rate = gain * b.btlBw
+	}
+	// a full window per rtt is the most kcp can send
+	b.rate = math.Min(b.rate, float64(b.maxWnd*b.mtu)/b.minRTT.Seconds())
+	if b.rate < ccMinRate {
+		b.rate = ccMinRate
+	}
+	return int64(b.rate), bdpWindow(b.rate, b.minRTT, b.mtu, b.maxWnd)
+}
+
+func (b *bbr) close() {}
+
+// bdpWindow returns a window of two bandwidth-delay products in packets
+func bdpWindow(rate float64, rtt time.Duration, mtu, maxWnd int) int {
+	wnd := int(2 * rate * rtt.Seconds() / float64(mtu))
+	if wnd < ccMinWnd {
+		wnd = ccMinWnd
+	}
+	if wnd > maxWnd {
+		wnd = maxWnd
+	}
+	return wnd
+}
+
+// fairShare divides a bandwidth evenly among the active sessions
+type fairShare struct {
+	bandwidth int64
+
+	mu       sync.Mutex
+	sessions int64
+}
+
+func (f *fairShare) add() {
+	f.mu.Lock()
+	f.sessions++
+	f.mu.Unlock()
+}
+
+func (f *fairShare) remove() {
+	f.mu.Lock()
+	f.sessions--
+	f.mu.Unlock()
+}
+
+func (f *fairShare) share() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sessions <= 1 {
+		return f.bandwidth
+	}
+	return f.bandwidth / f.sessions
+}
+
+// fairController caps the rate of a bbr controller to the fair share of
+// its session, so a session does not take over a shared link.
+type fairController struct {
+	Congestion
+	share *fairShare
+	mtu   int
+}
+
+func (f *fairController) update(s ccSample) (int64, int) {
+	rate, wnd := f.Congestion.update(s)
+	if share := f.share.share(); rate > share {
+		rate = share
+		if capped := bdpWindow(float64(rate), s.rtt, f.mtu, wnd); capped < wnd {
+			wnd = capped
+		}
+	}
+	return rate, wnd
+}
+
+func (f *fairController) close() { f.share.remove() }
+
+// Control feeds cc with the state of a session every ccInterval until
+// closed returns true, applying the pacing rate to its peer and the send
+// window to the session.
+func (c *PaceConn) Control(sess *kcp.UDPSession, cc Congestion, rcvwnd int, closed func() bool) {
+	defer cc.close()
+	addr := sess.RemoteAddr()
+	defer c.setRate(addr, 0)
+	log.Println("cc:", addr, "conv:", sess.GetConv(), "controller started")
+
+	ticker := time.NewTicker(ccInterval)
+	defer ticker.Stop()
+	last, _ := c.state(addr)
+	lastAt := time.Now()
+	for range ticker.C {
+		if closed() {
+			return
+		}
+		now := time.Now()
+		sent, queued := c.state(addr)
+		delta := sent - last
+		if sent < last {
+			// the pacer was restarted
+			delta = sent
+		}
+		last = sent
+		interval := now.Sub(lastAt)
+		lastAt = now
+
+		rtt := time.Duration(sess.GetSRTT()) * time.Millisecond
+		if rtt <= 0 {
+			continue
+		}
+		rate, wnd := cc.update(ccSample{rtt: rtt, sent: delta, interval: interval, queued: queued})
+		c.setRate(addr, rate)
+		if wnd > 0 {
+			sess.SetWindowSize(wnd, rcvwnd)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package generic
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// testLink emulates a path: a bottleneck of rate bytes per second with a
+// drop-tail buffer draining in queue, a one way delay and random loss.
+type testLink struct {
+	rate  float64
+	queue time.Duration
+	delay time.Duration
+	loss  float64
+
+	mu   sync.Mutex
+	next time.Time // when the bottleneck is free
+	rnd  *rand.Rand
+}
+
+func newTestLink(rate float64, queue, delay time.Duration, loss float64) *testLink {
+	return &testLink{rate: rate, queue: queue, delay: delay, loss: loss, rnd: rand.New(rand.NewSource(1))}
+}
+
+// linkConn sends the packets of its connection over a testLink
+type linkConn struct {
+	net.PacketConn
+	link *testLink
+}
+
+func (c *linkConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	l := c.link
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	drop := l.rnd.Float64() < l.loss || l.next.Sub(now) > l.queue
+	if !drop {
+		l.next = l.next.Add(time.Duration(float64(len(p)) / l.rate * float64(time.Second)))
+	}
+	at := l.next.Add(l.delay)
+	l.mu.Unlock()
+
+	if !drop {
+		pkt := append([]byte(nil), p...)
+		time.AfterFunc(time.Until(at), func() { c.PacketConn.WriteTo(pkt, addr) })
+	}
+	return len(p), nil
+}
+
+const (
+	simRate     = 1 << 20 // bytes per second of the bottleneck
+	simSessions = 2
+	simDuration = 6 * time.Second
+	simWarmup   = 2 * time.Second // excluded from the throughput
+	simMTU      = 1350
+	simWnd      = 1024
+)
+
+// simulate runs simSessions bulk transfers over a shared lossy link with the
+// controller called cc, it returns the throughput of each session.
+func simulate(t *testing.T, cc string) []float64 {
+	data := newTestLink(simRate, 100*time.Millisecond, 25*time.Millisecond, 0.01)
+	acks := newTestLink(100*simRate, time.Second, 25*time.Millisecond, 0)
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	block, _ := kcp.NewNoneBlockCrypt(nil)
+	lis, err := kcp.ServeConn(block, 0, 0, &linkConn{udp, acks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	// bytes received per client address, before and after the warmup
+	var mu sync.Mutex
+	received := make(map[string]*uint64)
+	go func() {
+		for {
+			sess, err := lis.AcceptKCP()
+			if err != nil {
+				return
+			}
+			sess.SetNoDelay(0, 20, 2, 1)
+			sess.SetWindowSize(simWnd, simWnd)
+			n := new(uint64)
+			mu.Lock()
+			received[sess.RemoteAddr().String()] = n
+			mu.Unlock()
+			go func() {
+				buf := make([]byte, 64*1024)
+				for {
+					m, err := sess.Read(buf)
+					if err != nil {
+						return
+					}
+					atomic.AddUint64(n, uint64(m))
+				}
+			}()
+		}
+	}()
+
+	var newCC CCFactory
+	if cc != "kcp" {
+		if newCC, err = NewCCFactory(cc, simRate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	die := make(chan struct{})
+	closed := func() bool {
+		select {
+		case <-die:
+			return true
+		default:
+			return false
+		}
+	}
+	var clients []string
+	for i := 0; i < simSessions; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// kcp does not close the conns it is given
+		defer conn.Close()
+		var wrapped net.PacketConn = &linkConn{conn, data}
+		var pc *PaceConn
+		if newCC != nil {
+			pc = NewPaceConn(wrapped, NewPaceStats())
+			wrapped = pc
+		}
+		sess, err := kcp.NewConn(udp.LocalAddr().String(), block, 0, 0, wrapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+		sess.SetStreamMode(true)
+		sess.SetMtu(simMTU)
+		sess.SetWindowSize(simWnd, simWnd)
+		if newCC != nil {
+			sess.SetNoDelay(0, 20, 2, 1)
+			go pc.Control(sess, newCC(simMTU, simWnd), simWnd, closed)
+		} else {
+			sess.SetNoDelay(0, 20, 2, 0)
+		}
+		clients = append(clients, conn.LocalAddr().String())
+		go func() {
+			buf := make([]byte, 32*1024)
+			for !closed() {
+				if _, err := sess.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	counters := func() []uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		n := make([]uint64, len(clients))
+		for i, addr := range clients {
+			if c, ok := received[addr]; ok {
+				n[i] = atomic.LoadUint64(c)
+			}
+		}
+		return n
+	}
+	time.Sleep(simWarmup)
+	start := counters()
+	time.Sleep(simDuration - simWarmup)
+	end := counters()
+	close(die)
+
+	rates := make([]float64, len(clients))
+	for i := range rates {
+		rates[i] = float64(end[i]-start[i]) / (simDuration - simWarmup).Seconds()
+	}
+	return rates
+}
+
+// TestCongestionSimulation compares the throughput and fairness of the
+// controllers on a shared lossy link.
+func TestCongestionSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs for seconds")
+	}
+	for _, cc := range []string{"kcp", "bbr", "fair"} {
+		rates := simulate(t, cc)
+		total, min, max := 0.0, rates[0], rates[0]
+		for _, r := range rates {
+			total += r
+			if r < min {
+				min = r
+			}
+			if r > max {
+				max = r
+			}
+		}
+		fairness := 0.0
+		if max > 0 {
+			fairness = min / max
+		}
+		t.Logf("%v: throughput %.0f B/s (%.0f%% of the link), per session %.0f, fairness %.2f",
+			cc, total, 100*total/simRate, rates, fairness)
+
+		if total < 0.3*simRate {
+			t.Errorf("%v: throughput %.0f B/s, want at least 30%% of %v", cc, total, simRate)
+		}
+		if cc != "kcp" && total > 1.1*simRate {
+			t.Errorf("%v: throughput %.0f B/s exceeds the link of %v", cc, total, simRate)
+		}
+		if cc == "fair" && fairness < 0.7 {
+			t.Errorf("fair: fairness %.2f, want at least 0.7", fairness)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+// Package generic contains the transport code shared by the client and the
+// server.
+package generic
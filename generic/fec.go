@@ -0,0 +1,497 @@
+package generic
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/pkg/errors"
+)
+
+const (
+	fecHeaderSize     = 8                           // data shards, parity shards, index, loss feedback, group
+	fecSizeSize       = 2                           // length prefix of data shards
+	FECOverhead       = fecHeaderSize + fecSizeSize // bytes added to a kcp packet
+	fecWindow         = 32                          // groups kept per peer for recovery
+	fecAdjustInterval = 5 * time.Second             // how often loss is measured and the parity adjusted
+	fecLowerAfter     = 3                           // intervals the loss must stay low before lowering the parity
+	fecPeerTimeout    = 2 * time.Minute             // peers idle for longer are forgotten
+	fecMinSamples     = 100                         // shards needed for a loss measurement
+	fecRestart        = 16 * fecWindow              // groups behind after which the peer is deemed restarted
+)
+
+// FECParams configures the adaptive FEC
+type FECParams struct {
+	dataShards   int
+	parityShards int // initial parity shards
+	minParity    int
+	maxParity    int
+	Stats        *FECCounters
+}
+
+// NewFECParams checks the shard bounds, the initial parity is clamped to them
+func NewFECParams(dataShards, parityShards, minParity, maxParity int) (*FECParams, error) {
+	if dataShards <= 0 || minParity < 0 || minParity > maxParity || dataShards+maxParity > 256 {
+		return nil, errors.Errorf("fec: invalid shards, datashard:%v minparity:%v maxparity:%v", dataShards, minParity, maxParity)
+	}
+	if parityShards < minParity {
+		parityShards = minParity
+	}
+	if parityShards > maxParity {
+		parityShards = maxParity
+	}
+	return &FECParams{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		minParity:    minParity,
+		maxParity:    maxParity,
+		Stats:        new(FECCounters),
+	}, nil
+}
+
+// FECCounters are the FEC statistics of the process, accessed atomically
+type FECCounters struct {
+	recovered     uint64 // data shards rebuilt from parity
+	unrecoverable uint64 // groups with data shards lost for good
+	adjustments   uint64 // parity changes
+}
+
+// LogStats prints the FEC statistics
+func (s *FECCounters) LogStats() {
+	log.Printf("fec: recovered:%v unrecoverable:%v adjustments:%v",
+		atomic.LoadUint64(&s.recovered),
+		atomic.LoadUint64(&s.unrecoverable),
+		atomic.LoadUint64(&s.adjustments))
+}
+
+// FECConn adds forward error correction to a packet connection, replacing
+// the fixed shards of kcp with shards tuned to the loss of every peer.
+//
+// Packets are sent in groups of data shards followed by parity shards, the
+// shards of a group are written in the header of each packet, so a sender
+// can change them at any group without coordination. Each packet also
+// carries the loss its sender measures on the packets it receives, which
+// the peer uses to tune the parity of its own groups; both ends must run
+// with adaptive FEC.
+type FECConn struct {
+	net.PacketConn
+	params FECParams
+
+	mu        sync.Mutex
+	peers     map[string]*fecPeer
+	encoders  map[[2]int]reedsolomon.Encoder
+	lastSweep time.Time
+
+	// read side, used by a single reader
+	rbuf  []byte
+	queue []fecPacket // recovered packets waiting to be read
+}
+
+// fecPacket is a recovered packet
+type fecPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// fecPeer is the FEC state of a remote address
+type fecPeer struct {
+	addr     string
+	lastSeen time.Time // guarded by fecConn.mu
+
+	mu sync.Mutex
+
+	// send side
+	group      uint32
+	shards     [][]byte // size prefixed data shards of the current group
+	data       int      // shards of the current group
+	parity     int
+	next       int // parity of the next groups
+	below      int // consecutive intervals with a lower target
+	lastAdjust time.Time
+	reported   byte // loss measured by the peer, in 1/255
+
+	// receive side
+	groups      map[uint32]*fecGroup
+	maxGroup    uint32
+	seen        bool
+	expected    uint64 // shards of the groups measured in this interval
+	received    uint64
+	loss        float64 // smoothed loss of the received packets
+	lastMeasure time.Time
+}
+
+// fecGroup is a received group
+type fecGroup struct {
+	data, parity int
+	shards       [][]byte
+	count        int
+	done         bool // recovery attempted
+}
+
+func NewFECConn(conn net.PacketConn, params FECParams) *FECConn {
+	return &FECConn{
+		PacketConn: conn,
+		params:     params,
+		peers:      make(map[string]*fecPeer),
+		encoders:   make(map[[2]int]reedsolomon.Encoder),
+		lastSweep:  time.Now(),
+		rbuf:       make([]byte, 65535),
+	}
+}
+
+// peer returns the state of addr, created on first use
+func (c *FECConn) peer(addr net.Addr) *fecPeer {
+	key := addr.String()
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > fecPeerTimeout {
+		for k, p := range c.peers {
+			if now.Sub(p.lastSeen) > fecPeerTimeout {
+				delete(c.peers, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	p, ok := c.peers[key]
+	if !ok {
+		p = &fecPeer{
+			addr:        key,
+			next:        c.params.parityShards,
+			lastAdjust:  now,
+			groups:      make(map[uint32]*fecGroup),
+			lastMeasure: now,
+		}
+		c.peers[key] = p
+	}
+	p.lastSeen = now
+	return p
+}
+
+// encoder returns the Reed-Solomon codec of a shard ratio
+func (c *FECConn) encoder(data, parity int) (reedsolomon.Encoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := [2]int{data, parity}
+	if enc, ok := c.encoders[key]; ok {
+		return enc, nil
+	}
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, errors.Wrap(err, "fec")
+	}
+	c.encoders[key] = enc
+	return enc, nil
+}
+
+// WriteTo sends p as a data shard, followed by the parity shards of its
+// group when it completes one.
+func (c *FECConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	peer := c.peer(addr)
+	peer.mu.Lock()
+	pkts, err := peer.encode(c, p)
+	peer.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	for k, pkt := range pkts {
+		if _, err := c.PacketConn.WriteTo(pkt, addr); err != nil && k == 0 {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// encode returns the packets to send for p, the caller must hold peer.mu
+func (peer *fecPeer) encode(c *FECConn, p []byte) ([][]byte, error) {
+	if len(p) > math.MaxUint16 {
+		return nil, errors.New("fec: packet too large")
+	}
+	if len(peer.shards) == 0 {
+		peer.adjust(c.params)
+		peer.data, peer.parity = c.params.dataShards, peer.next
+	}
+
+	pkt := make([]byte, fecHeaderSize+fecSizeSize+len(p))
+	peer.header(pkt, len(peer.shards))
+	binary.LittleEndian.PutUint16(pkt[fecHeaderSize:], uint16(len(p)))
+	copy(pkt[fecHeaderSize+fecSizeSize:], p)
+	pkts := [][]byte{pkt}
+	peer.shards = append(peer.shards, pkt[fecHeaderSize:])
+	if len(peer.shards) < peer.data {
+		return pkts, nil
+	}
+
+	// the group is complete
+	defer func() {
+		peer.shards = peer.shards[:0]
+		peer.group++
+	}()
+	if peer.parity == 0 {
+		return pkts, nil
+	}
+	enc, err := c.encoder(peer.data, peer.parity)
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, s := range peer.shards {
+		if len(s) > size {
+			size = len(s)
+		}
+	}
+	shards := make([][]byte, peer.data+peer.parity)
+	for k, s := range peer.shards {
+		shards[k] = make([]byte, size)
+		copy(shards[k], s)
+	}
+	for k := peer.data; k < len(shards); k++ {
+		pkt := make([]byte, fecHeaderSize+size)
+		peer.header(pkt, k)
+		shards[k] = pkt[fecHeaderSize:]
+		pkts = append(pkts, pkt)
+	}
+	if err := enc.Encode(shards); err != nil {
+		return nil, errors.Wrap(err, "fec")
+	}
+	return pkts, nil
+}
+
+// header writes the FEC header of the shard at index in the current group
+func (peer *fecPeer) header(pkt []byte, index int) {
+	pkt[0] = byte(peer.data)
+	pkt[1] = byte(peer.parity)
+	pkt[2] = byte(index)
+	pkt[3] = byte(math.Round(peer.loss * 255))
+	binary.LittleEndian.PutUint32(pkt[4:], peer.group)
+}
+
+// adjust tunes the parity of the next groups to the loss reported by the
+// peer, the parity is raised at once, but lowered one shard at a time
+// after the loss stayed low for a few intervals.
+func (peer *fecPeer) adjust(params FECParams) {
+	if time.Since(peer.lastAdjust) < fecAdjustInterval {
+		return
+	}
+	peer.lastAdjust = time.Now()
+
+	loss := float64(peer.reported) / 255
+	target := params.minParity
+	if loss > 0 {
+		// enough parity for twice the expected loss of a group
+		target = int(math.Ceil(2*loss*float64(params.dataShards))) + 1
+	}
+	if target < params.minParity {
+		target = params.minParity
+	}
+	if target > params.maxParity {
+		target = params.maxParity
+	}
+
+	old := peer.next
+	switch {
+	case target > peer.next:
+		peer.next = target
+		peer.below = 0
+	case target < peer.next:
+		if peer.below++; peer.below >= fecLowerAfter {
+			peer.next--
+			peer.below = 0
+		}
+	default:
+		peer.below = 0
+	}
+	if peer.next != old {
+		atomic.AddUint64(&params.Stats.adjustments, 1)
+		log.Printf("fec: %v datashard:%v parityshard:%v -> %v loss:%.2f%%",
+			peer.addr, params.dataShards, old, peer.next, loss*100)
+	}
+}
+
+// ReadFrom returns the next data shard received, or recovered from parity
+func (c *FECConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		if len(c.queue) > 0 {
+			pkt := c.queue[0]
+			c.queue[0] = fecPacket{}
+			c.queue = c.queue[1:]
+			return copy(b, pkt.data), pkt.addr, nil
+		}
+
+		n, addr, err := c.PacketConn.ReadFrom(c.rbuf)
+		if err != nil {
+			return 0, addr, err
+		}
+		if n < fecHeaderSize {
+			continue
+		}
+		peer := c.peer(addr)
+		peer.mu.Lock()
+		data, recovered := peer.decode(c, c.rbuf[:n])
+		peer.mu.Unlock()
+		for _, r := range recovered {
+			c.queue = append(c.queue, fecPacket{r, addr})
+		}
+		if data != nil {
+			return copy(b, data), addr, nil
+		}
+	}
+}
+
+// decode stores a received shard, it returns the packet of a data shard
+// and the packets recovered with it; the caller must hold peer.mu.
+func (peer *fecPeer) decode(c *FECConn, pkt []byte) (data []byte, recovered [][]byte) {
+	ndata, nparity, index := int(pkt[0]), int(pkt[1]), int(pkt[2])
+	gid := binary.LittleEndian.Uint32(pkt[4:])
+	shard := pkt[fecHeaderSize:]
+	if ndata == 0 || index >= ndata+nparity {
+		return nil, nil
+	}
+	peer.reported = pkt[3]
+	if index < ndata {
+		if len(shard) < fecSizeSize {
+			return nil, nil
+		}
+		size := int(binary.LittleEndian.Uint16(shard))
+		if fecSizeSize+size > len(shard) {
+			return nil, nil
+		}
+		data = shard[fecSizeSize : fecSizeSize+size]
+	}
+
+	if peer.seen && int32(peer.maxGroup-gid) > fecRestart {
+		// the peer starts over
+		peer.groups = make(map[uint32]*fecGroup)
+		peer.seen = false
+	}
+	if !peer.seen || int32(gid-peer.maxGroup) > 0 {
+		peer.maxGroup = gid
+		peer.seen = true
+		peer.expire(c.params.Stats)
+	}
+	if int32(peer.maxGroup-gid) >= fecWindow {
+		// too late to help recovering
+		return data, nil
+	}
+
+	g, ok := peer.groups[gid]
+	if !ok {
+		g = &fecGroup{data: ndata, parity: nparity, shards: make([][]byte, ndata+nparity)}
+		peer.groups[gid] = g
+	}
+	if g.data != ndata || g.parity != nparity || g.shards[index] != nil {
+		// duplicated or inconsistent
+		return nil, nil
+	}
+	g.shards[index] = append([]byte(nil), shard...)
+	g.count++
+
+	if !g.done && g.count >= g.data {
+		g.done = true
+		recovered = peer.recover(c, g)
+	}
+	return data, recovered
+}
+
+// recover rebuilds the missing data shards of a group
+func (peer *fecPeer) recover(c *FECConn, g *fecGroup) [][]byte {
+	size, missing := 0, false
+	for k, s := range g.shards {
+		if s == nil {
+			missing = missing || k < g.data
+		} else if k >= g.data {
+			size = len(s)
+		}
+	}
+	if !missing || size == 0 {
+		return nil
+	}
+
+	enc, err := c.encoder(g.data, g.parity)
+	if err != nil {
+		return nil
+	}
+	shards := make([][]byte, len(g.shards))
+	for k, s := range g.shards {
+		if s == nil {
+			continue
+		}
+		if len(s) > size {
+			return nil
+		}
+		shards[k] = make([]byte, size)
+		copy(shards[k], s)
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil
+	}
+
+	var recovered [][]byte
+	for k := 0; k < g.data; k++ {
+		if g.shards[k] != nil {
+			continue
+		}
+		g.shards[k] = shards[k]
+		n := int(binary.LittleEndian.Uint16(shards[k]))
+		if fecSizeSize+n <= size {
+			recovered = append(recovered, shards[k][fecSizeSize:fecSizeSize+n])
+			atomic.AddUint64(&c.params.Stats.recovered, 1)
+		}
+	}
+	return recovered
+}
+
+// expire drops the groups out of the window, counting their shards for
+// the loss measurement.
+func (peer *fecPeer) expire(stats *FECCounters) {
+	for gid, g := range peer.groups {
+		if int32(peer.maxGroup-gid) < fecWindow {
+			continue
+		}
+		peer.expected += uint64(g.data + g.parity)
+		peer.received += uint64(g.count)
+		for _, s := range g.shards[:g.data] {
+			if s == nil {
+				atomic.AddUint64(&stats.unrecoverable, 1)
+				break
+			}
+		}
+		delete(peer.groups, gid)
+	}
+
+	if time.Since(peer.lastMeasure) < fecAdjustInterval || peer.expected < fecMinSamples {
+		return
+	}
+	sample := 1 - float64(peer.received)/float64(peer.expected)
+	peer.loss = 0.7*peer.loss + 0.3*sample
+	peer.expected, peer.received = 0, 0
+	peer.lastMeasure = time.Now()
+}
+
+// Loss returns the loss rate of the packets sent to addr, as measured and
+// reported by the peer
+func (c *FECConn) Loss(addr net.Addr) float64 {
+	c.mu.Lock()
+	peer, ok := c.peers[addr.String()]
+	c.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	return float64(peer.reported) / 255
+}
+
+// SetReadBuffer sets the receive buffer of the wrapped connection
+func (c *FECConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.PacketConn, bytes) }
+
+// SetWriteBuffer sets the send buffer of the wrapped connection
+func (c *FECConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.PacketConn, bytes) }
+
+// SetDSCP sets the DSCP of the wrapped connection
+func (c *FECConn) SetDSCP(dscp int) error { return SetDSCP(c.PacketConn, dscp) }
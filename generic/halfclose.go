@@ -0,0 +1,171 @@
+package generic
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// smux has no half-close, a stream which won't send more data is announced
+// with a cmdFin header on a stream of its own. The frames of the data stream
+// precede the cmdFin on the session, so when the cmdFin is handled every
+// byte of the stream is already buffered on the receiving side; a read
+// deadline then ends the stream's reader once the buffer is drained.
+//
+// A stream closed without a cmdFin was aborted by the peer, its end is not
+// passed on as a half-close but resets the connection. As the cmdFin is
+// handled on a stream of its own, the close of a stream finned just before
+// may be read first, so the cmdFin is waited for a moment.
+
+// finWait is how long the close of a stream waits for its cmdFin
+const finWait = time.Second
+
+// FinTable tracks the half-closes received on a session
+type FinTable struct {
+	mu      sync.Mutex
+	streams map[uint32]*smux.Stream
+	fins    map[uint32]bool
+	waiters map[uint32]chan struct{} // closed on the cmdFin of the stream
+}
+
+func NewFinTable() *FinTable {
+	return &FinTable{streams: make(map[uint32]*smux.Stream), fins: make(map[uint32]bool), waiters: make(map[uint32]chan struct{})}
+}
+
+// add registers a stream relayed with half-close
+func (ft *FinTable) add(s *smux.Stream) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.streams[s.ID()] = s
+	if ft.fins[s.ID()] {
+		s.SetReadDeadline(time.Now())
+	}
+}
+
+func (ft *FinTable) remove(id uint32) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	delete(ft.streams, id)
+	delete(ft.fins, id)
+	delete(ft.waiters, id)
+}
+
+// Fin records a cmdFin for the stream id, the fin may arrive before the
+// stream is registered.
+func (ft *FinTable) Fin(id uint32) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.fins[id] = true
+	if s, ok := ft.streams[id]; ok {
+		s.SetReadDeadline(time.Now())
+	}
+	if ch, ok := ft.waiters[id]; ok {
+		close(ch)
+		delete(ft.waiters, id)
+	}
+}
+
+func (ft *FinTable) finned(id uint32) bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.fins[id]
+}
+
+// waitFin tells whether the cmdFin of the stream id arrives within timeout
+func (ft *FinTable) waitFin(id uint32, timeout time.Duration) bool {
+	ft.mu.Lock()
+	if ft.fins[id] {
+		ft.mu.Unlock()
+		return true
+	}
+	ch, ok := ft.waiters[id]
+	if !ok {
+		ch = make(chan struct{})
+		ft.waiters[id] = ch
+	}
+	ft.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return ft.finned(id)
+	}
+}
+
+// resetConn makes the close of conn reset the connection, so its peer does
+// not take an aborted stream for a complete one
+func resetConn(conn net.Conn) {
+	if l, ok := conn.(interface {
+		SetLinger(sec int) error
+	}); ok {
+		l.SetLinger(0)
+	}
+}
+
+// CloseWrite shuts down the writing side of conn
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return errors.Errorf("closeWrite: not supported on %T", conn)
+}
+
+// HalfCloseCopy relays between stream and conn through the given writers,
+// a direction reaching its end is half-closed on the other side, it returns
+// the reason when both directions are done, either fails or watch expires,
+// the caller closes both. fin sends the cmdFin of the stream to the peer. A
+// failed relay resets conn on its close.
+func HalfCloseCopy(stream *smux.Stream, conn net.Conn, toStream, toConn io.Writer, watch *StreamWatch, ft *FinTable, fin func(id uint32) error) string {
+	id := stream.ID()
+	ft.add(stream)
+	defer ft.remove(id)
+
+	die := make(chan struct{})
+	var once sync.Once
+	abort := func() { once.Do(func() { close(die) }) }
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// the stream ends at its cmdFin, a close without one is an abort
+		_, err := CopyBuffer(toConn, stream)
+		if err == nil && !ft.waitFin(id, finWait) {
+			abort()
+			return
+		}
+		if ft.finned(id) && CloseWrite(conn) == nil {
+			return
+		}
+		abort()
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := CopyBuffer(toStream, conn)
+		if err == nil && fin(id) == nil {
+			return
+		}
+		abort()
+	}()
+
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+		return "both sides closed"
+	case <-die:
+		resetConn(conn)
+		return "reset"
+	case reason := <-watch.Reason:
+		return reason
+	}
+}
@@ -0,0 +1,260 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// stream tags of the test tunnel, after the commands of the stream header
+const (
+	testConnect byte = 1
+	testFin     byte = 4
+)
+
+// testEnd is one end of a loopback tunnel, the session runs over tcp as the
+// half-close does not depend on kcp.
+type testEnd struct {
+	sess *smux.Session
+	fins *FinTable
+	data chan *smux.Stream // data streams accepted
+}
+
+// newTestTunnel returns the client and server ends of a tunnel
+func newTestTunnel(t *testing.T) (*testEnd, *testEnd) {
+	c, s := tcpPair(t)
+	cs, err := smux.Client(c, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := smux.Server(s, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &testEnd{sess: cs, fins: NewFinTable(), data: make(chan *smux.Stream, 1)}
+	server := &testEnd{sess: ss, fins: NewFinTable(), data: make(chan *smux.Stream, 1)}
+	go client.accept()
+	go server.accept()
+	return client, server
+}
+
+// accept records the fins and hands over the data streams
+func (e *testEnd) accept() {
+	for {
+		s, err := e.sess.AcceptStream()
+		if err != nil {
+			return
+		}
+		var hdr [5]byte
+		if _, err := io.ReadFull(s, hdr[:1]); err != nil {
+			s.Close()
+			continue
+		}
+		switch hdr[0] {
+		case testConnect:
+			e.data <- s
+		case testFin:
+			if _, err := io.ReadFull(s, hdr[1:]); err == nil {
+				e.fins.Fin(binary.BigEndian.Uint32(hdr[1:]))
+			}
+			s.Close()
+		}
+	}
+}
+
+// sendFin sends the cmdFin of the stream id
+func (e *testEnd) sendFin(id uint32) error {
+	s, err := e.sess.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	var fin [5]byte
+	fin[0] = testFin
+	binary.BigEndian.PutUint32(fin[1:], id)
+	_, err = s.Write(fin[:])
+	return err
+}
+
+// relay runs HalfCloseCopy between stream and conn, sending the result on
+// reason once both are closed
+func (e *testEnd) relay(stream *smux.Stream, conn net.Conn, reason chan<- string) {
+	watch := NewStreamWatch(10*time.Second, 0)
+	defer watch.Stop()
+	r := HalfCloseCopy(stream, conn, stream, conn, watch, e.fins, e.sendFin)
+	stream.Close()
+	conn.Close()
+	reason <- r
+}
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// startProxy connects app to target through the tunnel as the client and
+// server do, hold delays the server relay of the stream. It returns the
+// channels receiving the reasons the relays end with.
+func startProxy(t *testing.T, client, server *testEnd, hold func(id uint32)) (app, target *net.TCPConn, clientReason, serverReason chan string) {
+	app, local := tcpPair(t)
+	remote, target := tcpPair(t)
+	app.SetDeadline(time.Now().Add(5 * time.Second))
+	target.SetDeadline(time.Now().Add(5 * time.Second))
+
+	stream, err := client.sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte{testConnect}); err != nil {
+		t.Fatal(err)
+	}
+	clientReason, serverReason = make(chan string, 1), make(chan string, 1)
+	go client.relay(stream, local, clientReason)
+	go func() {
+		s := <-server.data
+		if hold != nil {
+			hold(s.ID())
+		}
+		server.relay(s, remote, serverReason)
+	}()
+	return app, target, clientReason, serverReason
+}
+
+func readAll(t *testing.T, conn net.Conn, want string) {
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+}
+
+func checkReason(t *testing.T, side string, reason <-chan string) {
+	select {
+	case r := <-reason:
+		if r != "both sides closed" {
+			t.Fatalf("%v relay ended with %q", side, r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%v relay did not end", side)
+	}
+}
+
+// the client half-closes, the server still sends its response
+func TestHalfCloseFromClient(t *testing.T) {
+	client, server := newTestTunnel(t)
+	defer client.sess.Close()
+	defer server.sess.Close()
+	app, target, cr, sr := startProxy(t, client, server, nil)
+
+	app.Write([]byte("request"))
+	app.CloseWrite()
+	readAll(t, target, "request")
+	target.Write([]byte("response"))
+	target.Close()
+	readAll(t, app, "response")
+	app.Close()
+
+	checkReason(t, "client", cr)
+	checkReason(t, "server", sr)
+}
+
+// the server half-closes, the client still sends its request
+func TestHalfCloseFromServer(t *testing.T) {
+	client, server := newTestTunnel(t)
+	defer client.sess.Close()
+	defer server.sess.Close()
+	app, target, cr, sr := startProxy(t, client, server, nil)
+
+	target.Write([]byte("greeting"))
+	target.CloseWrite()
+	readAll(t, app, "greeting")
+	app.Write([]byte("request"))
+	app.Close()
+	readAll(t, target, "request")
+	target.Close()
+
+	checkReason(t, "client", cr)
+	checkReason(t, "server", sr)
+}
+
+// the cmdFin of a stream is handled before the stream is registered
+func TestHalfCloseFinBeforeStream(t *testing.T) {
+	client, server := newTestTunnel(t)
+	defer client.sess.Close()
+	defer server.sess.Close()
+	hold := func(id uint32) {
+		for deadline := time.Now().Add(5 * time.Second); !server.fins.finned(id); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Error("no cmdFin received")
+				return
+			}
+		}
+	}
+	app, target, cr, sr := startProxy(t, client, server, hold)
+
+	app.Write([]byte("request"))
+	app.CloseWrite()
+	readAll(t, target, "request")
+	target.Write([]byte("response"))
+	target.Close()
+	readAll(t, app, "response")
+	app.Close()
+
+	checkReason(t, "client", cr)
+	checkReason(t, "server", sr)
+}
+
+// the server closes the stream without a cmdFin, the client app must not
+// take the partial response for a complete one
+func TestHalfCloseStreamReset(t *testing.T) {
+	client, server := newTestTunnel(t)
+	defer client.sess.Close()
+	defer server.sess.Close()
+	app, local := tcpPair(t)
+	app.SetDeadline(time.Now().Add(5 * time.Second))
+
+	stream, err := client.sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte{testConnect}); err != nil {
+		t.Fatal(err)
+	}
+	reason := make(chan string, 1)
+	go client.relay(stream, local, reason)
+
+	s := <-server.data
+	s.Write([]byte("partial"))
+	s.Close()
+
+	if _, err := ioutil.ReadAll(app); err == nil {
+		t.Fatal("aborted stream read as complete")
+	}
+	select {
+	case r := <-reason:
+		if r != "reset" {
+			t.Fatalf("client relay ended with %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client relay did not end")
+	}
+}
@@ -0,0 +1,208 @@
+package generic
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	paceQueueLen    = 256                  // packets waiting per peer, more are dropped
+	paceBurst       = 2 * time.Millisecond // sending time a peer may catch up after a sleep
+	pacePeerTimeout = 2 * time.Minute      // idle peers stop their sender
+)
+
+// PaceConn spaces the packets sent to every peer at the rate set for it,
+// packets to a peer without a rate are sent at once, once those queued
+// while it had one are sent.
+type PaceConn struct {
+	net.PacketConn
+
+	stats *PaceStats
+
+	mu     sync.Mutex
+	pacers map[string]*pacer
+}
+
+// pacer queues the packets of a peer and sends them at its rate
+type pacer struct {
+	addr  net.Addr
+	queue chan pacedPacket
+
+	rate    int64  // bytes per second, 0 for unpaced, accessed atomically
+	pending int64  // packets queued and not sent yet, accessed atomically
+	delay   int64  // smoothed time packets wait in the queue, accessed atomically
+	sent    uint64 // bytes sent, accessed atomically
+	dropped uint64 // packets dropped on a full queue, accessed atomically
+}
+
+type pacedPacket struct {
+	data []byte
+	at   time.Time // when queued
+}
+
+func NewPaceConn(conn net.PacketConn, stats *PaceStats) *PaceConn {
+	return &PaceConn{PacketConn: conn, stats: stats, pacers: make(map[string]*pacer)}
+}
+
+// pacer returns the pacer of addr, started on first use, the caller must
+// hold c.mu.
+func (c *PaceConn) pacer(addr net.Addr) *pacer {
+	key := addr.String()
+	p, ok := c.pacers[key]
+	if !ok {
+		p = &pacer{addr: addr, queue: make(chan pacedPacket, paceQueueLen)}
+		c.pacers[key] = p
+		c.stats.add(p)
+		go c.send(p)
+	}
+	return p
+}
+
+// WriteTo queues p for a paced peer, or for a peer with packets still
+// queued so they are not overtaken, or sends it
+func (c *PaceConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	pc := c.pacer(addr)
+	if atomic.LoadInt64(&pc.rate) > 0 || atomic.LoadInt64(&pc.pending) > 0 {
+		atomic.AddInt64(&pc.pending, 1)
+		select {
+		case pc.queue <- pacedPacket{append([]byte(nil), p...), time.Now()}:
+		default:
+			// a full queue is a full router buffer, kcp retransmits
+			atomic.AddInt64(&pc.pending, -1)
+			atomic.AddUint64(&pc.dropped, 1)
+		}
+		c.mu.Unlock()
+		return len(p), nil
+	}
+	c.mu.Unlock()
+
+	n, err := c.PacketConn.WriteTo(p, addr)
+	atomic.AddUint64(&pc.sent, uint64(n))
+	return n, err
+}
+
+// send writes the queued packets of p at its rate, it returns once p has
+// been idle for pacePeerTimeout.
+func (c *PaceConn) send(p *pacer) {
+	idle := time.NewTimer(pacePeerTimeout)
+	defer idle.Stop()
+	var next time.Time
+	for {
+		select {
+		case pkt := <-p.queue:
+			now := time.Now()
+			if rate := atomic.LoadInt64(&p.rate); rate > 0 {
+				if next.Before(now.Add(-paceBurst)) {
+					next = now.Add(-paceBurst)
+				}
+				if d := next.Sub(now); d > 0 {
+					time.Sleep(d)
+				}
+				next = next.Add(time.Duration(int64(len(pkt.data)) * int64(time.Second) / rate))
+			}
+			if n, err := c.PacketConn.WriteTo(pkt.data, p.addr); err == nil {
+				atomic.AddUint64(&p.sent, uint64(n))
+			}
+			atomic.AddInt64(&p.pending, -1)
+			delay := atomic.LoadInt64(&p.delay)
+			atomic.StoreInt64(&p.delay, delay+(int64(time.Since(pkt.at))-delay)/8)
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(pacePeerTimeout)
+		case <-idle.C:
+			c.mu.Lock()
+			if len(p.queue) == 0 {
+				delete(c.pacers, p.addr.String())
+				c.mu.Unlock()
+				c.stats.remove(p)
+				return
+			}
+			c.mu.Unlock()
+			idle.Reset(pacePeerTimeout)
+		}
+	}
+}
+
+// SetReadBuffer sets the receive buffer of the wrapped connection
+func (c *PaceConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.PacketConn, bytes) }
+
+// SetWriteBuffer sets the send buffer of the wrapped connection
+func (c *PaceConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.PacketConn, bytes) }
+
+// SetDSCP sets the DSCP of the wrapped connection
+func (c *PaceConn) SetDSCP(dscp int) error { return SetDSCP(c.PacketConn, dscp) }
+
+// setRate sets the pacing rate of addr in bytes per second, 0 to stop
+// pacing it.
+func (c *PaceConn) setRate(addr net.Addr, rate int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	atomic.StoreInt64(&c.pacer(addr).rate, rate)
+}
+
+// state returns the bytes sent to addr and the packets waiting for it
+func (c *PaceConn) state(addr net.Addr) (sent uint64, queued int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.pacer(addr)
+	return atomic.LoadUint64(&p.sent), len(p.queue)
+}
+
+// PaceStats are the paced peers of the process
+type PaceStats struct {
+	mu     sync.Mutex
+	pacers map[*pacer]struct{}
+}
+
+func NewPaceStats() *PaceStats {
+	return &PaceStats{pacers: make(map[*pacer]struct{})}
+}
+
+func (s *PaceStats) add(p *pacer) {
+	s.mu.Lock()
+	s.pacers[p] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *PaceStats) remove(p *pacer) {
+	s.mu.Lock()
+	delete(s.pacers, p)
+	s.mu.Unlock()
+}
+
+// LogStats prints the pacing rate and queue delay of every paced peer
+func (s *PaceStats) LogStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.pacers {
+		rate := atomic.LoadInt64(&p.rate)
+		if rate == 0 {
+			continue
+		}
+		log.Printf("pace: %v rate:%v queued:%v delay:%v sent:%v dropped:%v",
+			p.addr, rate, len(p.queue),
+			time.Duration(atomic.LoadInt64(&p.delay)),
+			atomic.LoadUint64(&p.sent),
+			atomic.LoadUint64(&p.dropped))
+	}
+}
+
+// pacing paces a session at the bandwidth estimated by bbr and leaves the
+// send window to kcp, the option --pacing without a congestion controller.
+type pacing struct {
+	*bbr
+}
+
+func NewPacing(mtu, maxWnd int) Congestion {
+	return pacing{newBBR(mtu, maxWnd)}
+}
+
+func (p pacing) update(s ccSample) (int64, int) {
+	rate, _ := p.bbr.update(s)
+	return rate, 0
+}
@@ -0,0 +1,62 @@
+package generic
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordConn records the first byte of the packets written to it
+type recordConn struct {
+	net.PacketConn
+
+	mu   sync.Mutex
+	sent []byte
+}
+
+func (c *recordConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.sent = append(c.sent, p[0])
+	c.mu.Unlock()
+	return len(p), nil
+}
+
+func (c *recordConn) packets() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.sent...)
+}
+
+// TestPaceRateDrop checks the packets queued for a peer are not overtaken
+// by the ones written once it is no longer paced.
+func TestPaceRateDrop(t *testing.T) {
+	rc := new(recordConn)
+	c := NewPaceConn(rc, NewPaceStats())
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	const packets = 10
+	pkt := make([]byte, 100)
+	c.setRate(addr, 1000)
+	for i := 0; i < packets; i++ {
+		if i == packets/2 {
+			c.setRate(addr, 0)
+		}
+		pkt[0] = byte(i)
+		c.WriteTo(pkt, addr)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rc.packets()) < packets && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sent := rc.packets()
+	if len(sent) != packets {
+		t.Fatalf("sent %v packets, want %v", len(sent), packets)
+	}
+	for i, b := range sent {
+		if int(b) != i {
+			t.Fatalf("sent %v, want the packets in order", sent)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+const (
+	pmtuMin        = 548              // udp payload every path carries, 576 minus the ip and udp headers
+	pmtuMax        = 1472             // udp payload of an ethernet frame
+	pmtuStep       = 8                // precision of the search
+	pmtuTimeout    = time.Second      // wait for the ack of a probe
+	pmtuRetries    = 3                // probes lost before a size is deemed too large
+	pmtuInterval   = 10 * time.Minute // how often the path is probed again
+	pmtuHeaderSize = 13               // magic, type, id
+)
+
+// pmtuMagic marks probes, a kcp packet starts with a random nonce or a
+// conversation id, so is told apart from a probe by the magic.
+var pmtuMagic = [8]byte{0x6b, 0x63, 0x70, 0x74, 0x70, 0x6d, 0x74, 0x75}
+
+// probe types
+const (
+	pmtuProbe byte = iota + 1
+	pmtuAck
+)
+
+// PMTUConn discovers the path MTU of its peers by sending probes with the
+// DF bit set, the probes are answered by the PMTUConn of the peer, so both
+// ends must run with path MTU discovery. The DF bit is set on the socket
+// only while probing, so the packets of a session falling back to the
+// configured mtu are fragmented rather than dropped.
+type PMTUConn struct {
+	net.PacketConn
+	df bool // whether the DF bit could be set
+
+	mu      sync.Mutex
+	nextID  uint32
+	waiters map[uint32]chan struct{}
+	probing int // peers being probed, the DF bit is set while > 0
+}
+
+func NewPMTUConn(conn net.PacketConn) *PMTUConn {
+	c := &PMTUConn{PacketConn: conn, waiters: make(map[uint32]chan struct{})}
+	if err := setDontFragment(conn, false); err != nil {
+		log.Println("pmtu:", err)
+	} else {
+		c.df = true
+	}
+	return c
+}
+
+// ReadFrom answers the probes and returns the other packets
+func (c *PMTUConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || n < pmtuHeaderSize || !bytes.Equal(b[:len(pmtuMagic)], pmtuMagic[:]) {
+			return n, addr, err
+		}
+
+		id := binary.LittleEndian.Uint32(b[len(pmtuMagic)+1:])
+		switch b[len(pmtuMagic)] {
+		case pmtuProbe:
+			c.PacketConn.WriteTo(pmtuPacket(pmtuAck, id, pmtuHeaderSize), addr)
+		case pmtuAck:
+			c.mu.Lock()
+			if ch, ok := c.waiters[id]; ok {
+				delete(c.waiters, id)
+				close(ch)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// SetReadBuffer sets the receive buffer of the wrapped connection
+func (c *PMTUConn) SetReadBuffer(bytes int) error { return SetReadBuffer(c.PacketConn, bytes) }
+
+// SetWriteBuffer sets the send buffer of the wrapped connection
+func (c *PMTUConn) SetWriteBuffer(bytes int) error { return SetWriteBuffer(c.PacketConn, bytes) }
+
+// SetDSCP sets the DSCP of the wrapped connection
+func (c *PMTUConn) SetDSCP(dscp int) error { return SetDSCP(c.PacketConn, dscp) }
+
+func pmtuPacket(typ byte, id uint32, size int) []byte {
+	pkt := make([]byte, size)
+	copy(pkt, pmtuMagic[:])
+	pkt[len(pmtuMagic)] = typ
+	binary.LittleEndian.PutUint32(pkt[len(pmtuMagic)+1:], id)
+	return pkt
+}
+
+// probe tells whether a packet of size reaches addr
+func (c *PMTUConn) probe(addr net.Addr, size int) bool {
+	for i := 0; i < pmtuRetries; i++ {
+		c.mu.Lock()
+		c.nextID++
+		id := c.nextID
+		ch := make(chan struct{})
+		c.waiters[id] = ch
+		c.mu.Unlock()
+
+		if _, err := c.PacketConn.WriteTo(pmtuPacket(pmtuProbe, id, size), addr); err == nil {
+			select {
+			case <-ch:
+				return true
+			case <-time.After(pmtuTimeout):
+			}
+		}
+		c.mu.Lock()
+		delete(c.waiters, id)
+		c.mu.Unlock()
+	}
+	return false
+}
+
+// dontFragment sets the DF bit when the first probing starts and clears it
+// when the last one ends.
+func (c *PMTUConn) dontFragment(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if on {
+		c.probing++
+	} else {
+		c.probing--
+	}
+	if (on && c.probing == 1) || (!on && c.probing == 0) {
+		if err := setDontFragment(c.PacketConn, on); err != nil {
+			log.Println("pmtu:", err)
+		}
+	}
+}
+
+// discover returns the largest udp payload reaching addr, or 0 when the
+// path can't be probed.
+func (c *PMTUConn) discover(addr net.Addr) int {
+	if !c.df {
+		return 0
+	}
+	c.dontFragment(true)
+	defer c.dontFragment(false)
+	if !c.probe(addr, pmtuMin) {
+		return 0
+	}
+	if c.probe(addr, pmtuMax) {
+		return pmtuMax
+	}
+	// lo is known to fit, hi not to
+	lo, hi := pmtuMin, pmtuMax
+	for hi-lo > pmtuStep {
+		mid := (lo + hi) / 2
+		if c.probe(addr, mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// Run probes the path of a session until closed returns true, applying
+// the result to the session minus the overhead of the connections above;
+// mtu, the value the session was created with, is kept when probing fails.
+func (c *PMTUConn) Run(sess *kcp.UDPSession, mtu, overhead int, closed func() bool) {
+	current := mtu
+	ticker := time.NewTicker(tuneInterval)
+	defer ticker.Stop()
+	var last time.Time
+	for ; !closed(); <-ticker.C {
+		if time.Since(last) < pmtuInterval {
+			continue
+		}
+		last = time.Now()
+
+		next := mtu
+		if pmtu := c.discover(sess.RemoteAddr()); pmtu > 0 {
+			next = pmtu - overhead
+			log.Println("pmtu:", sess.RemoteAddr(), "path mtu:", pmtu)
+		} else {
+			log.Println("pmtu:", sess.RemoteAddr(), "probing failed, mtu:", mtu)
+		}
+		if next != current && !closed() {
+			sess.SetMtu(next)
+			current = next
+			log.Println("pmtu:", sess.RemoteAddr(), "conv:", sess.GetConv(), "mtu:", next)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package generic
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// setDontFragment sets the DF bit on the packets of conn when on, without
+// using the path MTU cached by the kernel so probes larger than it are sent,
+// and clears it otherwise so packets larger than the path are fragmented.
+func setDontFragment(conn net.PacketConn, on bool) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("setDontFragment: not a socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return errors.Wrap(err, "setDontFragment")
+	}
+	mode := syscall.IP_PMTUDISC_DONT
+	if on {
+		mode = syscall.IP_PMTUDISC_PROBE
+	}
+	var err4, err6 error
+	if err := raw.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, mode)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, mode)
+	}); err != nil {
+		return errors.Wrap(err, "setDontFragment")
+	}
+	// a socket is ipv4, ipv6 or both
+	if err4 != nil && err6 != nil {
+		return errors.Wrap(err4, "setDontFragment")
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package generic
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+func setDontFragment(conn net.PacketConn, on bool) error {
+	return errors.New("path mtu discovery is not supported on this platform")
+}
@@ -0,0 +1,112 @@
+package generic
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// builtinProfiles are the presets selected by --mode, in the format of the
+// profiles of the config file.
+const builtinProfiles = `{
+	"normal": {"nodelay": 0, "interval": 40, "resend": 2, "nc": 1},
+	"fast":   {"nodelay": 0, "interval": 30, "resend": 2, "nc": 1},
+	"fast2":  {"nodelay": 1, "interval": 20, "resend": 2, "nc": 1},
+	"fast3":  {"nodelay": 1, "interval": 10, "resend": 2, "nc": 1},
+	"auto":   {"nodelay": 0, "interval": 30, "resend": 2, "nc": 1, "auto": true}
+}`
+
+// Profile is a named set of kcp parameters, the parameters it leaves out
+// keep the value of their options.
+type Profile struct {
+	NoDelay      *int  `json:"nodelay,omitempty"`
+	Interval     *int  `json:"interval,omitempty"`
+	Resend       *int  `json:"resend,omitempty"`
+	NoCongestion *int  `json:"nc,omitempty"`
+	SndWnd       *int  `json:"sndwnd,omitempty"`
+	RcvWnd       *int  `json:"rcvwnd,omitempty"`
+	MTU          *int  `json:"mtu,omitempty"`
+	DataShard    *int  `json:"datashard,omitempty"`
+	ParityShard  *int  `json:"parityshard,omitempty"`
+	AckNodelay   *bool `json:"acknodelay,omitempty"`
+
+	// Auto tunes the parameters of each session from the values above
+	Auto bool `json:"auto,omitempty"`
+}
+
+// profiles returns the built-in presets and the profiles of the config
+// file, which take precedence.
+func profiles(custom map[string]*Profile) map[string]*Profile {
+	all := make(map[string]*Profile)
+	if err := json.Unmarshal([]byte(builtinProfiles), &all); err != nil {
+		panic(err)
+	}
+	for name, p := range custom {
+		all[name] = p
+	}
+	return all
+}
+
+// LookupProfile returns the profile called name, "manual" is the empty
+// profile leaving every option as set. Without profiles in the config file,
+// an unknown name is taken as "manual", as before profiles existed.
+func LookupProfile(name string, custom map[string]*Profile) (*Profile, error) {
+	if name == "manual" {
+		return new(Profile), nil
+	}
+	p, ok := profiles(custom)[name]
+	if !ok && len(custom) == 0 {
+		log.Println("unknown mode", name, "the options are kept as set")
+		return new(Profile), nil
+	}
+	if !ok || p == nil {
+		return nil, errors.Errorf("lookupProfile: unknown profile %v", name)
+	}
+	return p, nil
+}
+
+// Options points to the options a profile sets
+type Options struct {
+	NoDelay, Interval, Resend, NoCongestion *int
+	SndWnd, RcvWnd, MTU                     *int
+	DataShard, ParityShard                  *int
+	AckNodelay                              *bool
+}
+
+// Apply sets the parameters of the profile in the options
+func (p *Profile) Apply(o Options) {
+	for _, v := range []struct {
+		dst *int
+		src *int
+	}{
+		{o.NoDelay, p.NoDelay},
+		{o.Interval, p.Interval},
+		{o.Resend, p.Resend},
+		{o.NoCongestion, p.NoCongestion},
+		{o.SndWnd, p.SndWnd},
+		{o.RcvWnd, p.RcvWnd},
+		{o.MTU, p.MTU},
+		{o.DataShard, p.DataShard},
+		{o.ParityShard, p.ParityShard},
+	} {
+		if v.src != nil {
+			*v.dst = *v.src
+		}
+	}
+	if p.AckNodelay != nil {
+		*o.AckNodelay = *p.AckNodelay
+	}
+}
+
+// PrintProfiles writes every profile to stdout, as the profiles of a
+// config file
+func PrintProfiles(custom map[string]*Profile) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(struct {
+		Profiles map[string]*Profile `json:"profiles"`
+	}{profiles(custom)})
+	return errors.Wrap(err, "printProfiles")
+}
@@ -0,0 +1,47 @@
+package generic
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// The connections of this package wrap the UDP socket of kcp, which then
+// fails to set the socket options itself: the options are passed down the
+// wrappers to the socket by the functions below.
+
+// SetDSCP sets the DSCP of the packets sent on conn
+func SetDSCP(conn net.PacketConn, dscp int) error {
+	if c, ok := conn.(interface{ SetDSCP(int) error }); ok {
+		return c.SetDSCP(dscp)
+	}
+	nc, ok := conn.(net.Conn)
+	if !ok {
+		return errors.Errorf("SetDSCP: not supported on %T", conn)
+	}
+	// either succeeds on a dual stack socket
+	err4 := ipv4.NewConn(nc).SetTOS(dscp << 2)
+	err6 := ipv6.NewConn(nc).SetTrafficClass(dscp)
+	if err4 != nil && err6 != nil {
+		return errors.Wrap(err4, "SetDSCP")
+	}
+	return nil
+}
+
+// SetReadBuffer sets the receive buffer of conn
+func SetReadBuffer(conn net.PacketConn, bytes int) error {
+	if c, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+		return c.SetReadBuffer(bytes)
+	}
+	return errors.Errorf("SetReadBuffer: not supported on %T", conn)
+}
+
+// SetWriteBuffer sets the send buffer of conn
+func SetWriteBuffer(conn net.PacketConn, bytes int) error {
+	if c, ok := conn.(interface{ SetWriteBuffer(int) error }); ok {
+		return c.SetWriteBuffer(bytes)
+	}
+	return errors.Errorf("SetWriteBuffer: not supported on %T", conn)
+}
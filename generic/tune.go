@@ -0,0 +1,114 @@
+package generic
+
+import (
+	"log"
+	"math"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+const (
+	tuneDelay    = 3 * time.Second  // time for a new session to collect rtt samples
+	tuneInterval = 10 * time.Second // how often a session is tuned
+)
+
+// KCPProfile is a set of kcp parameters
+type KCPProfile struct {
+	NoDelay, Interval, Resend, NoCongestion int
+	SndWnd, RcvWnd                          int
+}
+
+// AutoTuner adjusts the kcp parameters of a session to its rtt, jitter and
+// loss, the mode "auto". kcp counts retransmissions for the whole process
+// only, so the loss comes from a measurement of the session given by the
+// caller; a session without one is tuned to its rtt and jitter.
+type AutoTuner struct {
+	conn           *kcp.UDPSession
+	sndwnd, rcvwnd int  // configured windows, the largest used
+	cc             bool // nc and the send window are left to a congestion controller
+	loss           func() float64
+	current        KCPProfile
+	minRTT         time.Duration
+}
+
+// NewAutoTuner returns the tuner of conn, loss returns the loss rate of the
+// packets sent by the session, nil if not measured.
+func NewAutoTuner(conn *kcp.UDPSession, initial KCPProfile, cc bool, loss func() float64) *AutoTuner {
+	return &AutoTuner{conn: conn, sndwnd: initial.SndWnd, rcvwnd: initial.RcvWnd, cc: cc, loss: loss, current: initial}
+}
+
+// Run tunes the session until closed returns true
+func (t *AutoTuner) Run(closed func() bool) {
+	time.Sleep(tuneDelay)
+	ticker := time.NewTicker(tuneInterval)
+	defer ticker.Stop()
+	for !closed() {
+		t.tune()
+		<-ticker.C
+	}
+}
+
+// tune applies the profile matching the current measurements, if changed
+func (t *AutoTuner) tune() {
+	rtt := time.Duration(t.conn.GetSRTT()) * time.Millisecond
+	if rtt <= 0 {
+		// no samples yet
+		return
+	}
+	jitter := time.Duration(t.conn.GetSRTTVar()) * time.Millisecond
+	if t.minRTT == 0 || rtt < t.minRTT {
+		t.minRTT = rtt
+	}
+	loss := -1.0
+	if t.loss != nil {
+		loss = t.loss()
+	}
+
+	p := autoProfile(rtt, jitter, t.minRTT, loss, t.sndwnd, t.rcvwnd)
+	if t.cc {
+		p.NoCongestion, p.SndWnd = 1, t.sndwnd
+	}
+	if p == t.current {
+		return
+	}
+	t.conn.SetNoDelay(p.NoDelay, p.Interval, p.Resend, p.NoCongestion)
+	if !t.cc {
+		t.conn.SetWindowSize(p.SndWnd, p.RcvWnd)
+	}
+	t.current = p
+	log.Printf("auto: conv:%v rtt:%v minrtt:%v jitter:%v loss:%.2f%% nodelay:%v interval:%v resend:%v nc:%v sndwnd:%v rcvwnd:%v",
+		t.conn.GetConv(), rtt, t.minRTT, jitter, math.Max(loss, 0)*100,
+		p.NoDelay, p.Interval, p.Resend, p.NoCongestion, p.SndWnd, p.RcvWnd)
+}
+
+// autoProfile chooses the kcp parameters for a link, loss is negative when
+// it is not measured
+func autoProfile(rtt, jitter, minRTT time.Duration, loss float64, sndwnd, rcvwnd int) KCPProfile {
+	p := KCPProfile{Resend: 2, NoCongestion: 1, SndWnd: sndwnd, RcvWnd: rcvwnd}
+
+	// update a few times per rtt, from fast3 (10ms) to normal (40ms)
+	p.Interval = int(rtt/time.Millisecond) / 40 * 10
+	if p.Interval < 10 {
+		p.Interval = 10
+	} else if p.Interval > 40 {
+		p.Interval = 40
+	}
+	// retransmit lost segments sooner on lossy links
+	if loss > 0.01 {
+		p.NoDelay = 1
+	}
+	// jitter reorders segments, wait for more acks before a fast resend
+	if jitter > rtt/2 {
+		p.Resend = 3
+	}
+	// a growing queue, with loss when it is measured, is congestion, back
+	// off instead of retransmitting harder
+	if rtt > minRTT*3/2 && (loss < 0 || loss > 0.01) {
+		p.NoCongestion = 0
+		if p.SndWnd /= 2; p.SndWnd < 32 {
+			p.SndWnd = 32
+		}
+	}
+	return p
+}
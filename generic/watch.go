@@ -0,0 +1,83 @@
+package generic
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reasonIdle     = "idle timeout"
+	reasonLifetime = "lifetime exceeded"
+)
+
+// StreamWatch ends a stream idle for longer than idle or alive for longer
+// than life, zero disables either; the reason is delivered on the Reason
+// channel.
+type StreamWatch struct {
+	last   int64 // UnixNano of the last transfer, accessed atomically
+	idle   time.Duration
+	Reason chan string
+
+	idleTimer *time.Timer
+	lifeTimer *time.Timer
+}
+
+func NewStreamWatch(idle, life time.Duration) *StreamWatch {
+	w := &StreamWatch{idle: idle, Reason: make(chan string, 1)}
+	w.touch()
+	if idle > 0 {
+		w.idleTimer = time.AfterFunc(idle, w.checkIdle)
+	}
+	if life > 0 {
+		w.lifeTimer = time.AfterFunc(life, func() { w.expire(reasonLifetime) })
+	}
+	return w
+}
+
+func (w *StreamWatch) touch() { atomic.StoreInt64(&w.last, time.Now().UnixNano()) }
+
+func (w *StreamWatch) checkIdle() {
+	if d := time.Since(time.Unix(0, atomic.LoadInt64(&w.last))); d < w.idle {
+		w.idleTimer.Reset(w.idle - d)
+		return
+	}
+	w.expire(reasonIdle)
+}
+
+func (w *StreamWatch) expire(reason string) {
+	select {
+	case w.Reason <- reason:
+	default:
+	}
+}
+
+func (w *StreamWatch) Stop() {
+	if w.idleTimer != nil {
+		w.idleTimer.Stop()
+	}
+	if w.lifeTimer != nil {
+		w.lifeTimer.Stop()
+	}
+}
+
+// Writer records the writes to wr as activity
+func (w *StreamWatch) Writer(wr io.Writer) io.Writer {
+	if w.idle <= 0 {
+		return wr
+	}
+	return &watchWriter{Writer: wr, w: w}
+}
+
+type watchWriter struct {
+	io.Writer
+	w *StreamWatch
+}
+
+func (ww *watchWriter) Write(p []byte) (int, error) {
+	ww.w.touch()
+	return ww.Writer.Write(p)
+}
+
+// TimedOut tells whether a stream was ended by its watch
+func TimedOut(reason string) bool { return reason == reasonIdle || reason == reasonLifetime }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// aclRule allows or denies the peers in a network
+type aclRule struct {
+	allow   bool
+	network *net.IPNet
+	text    string // the rule as written
+	hits    uint64 // accessed atomically
+}
+
+// acl filters kcp peers by address, the rules are read from a file, one
+// per line as "allow|deny CIDR|IP", lines starting with # are comments. The
+// first matching rule applies, a peer matching no rule is denied when the
+// file has allow rules, allowed otherwise.
+type acl struct {
+	path string
+
+	mu     sync.RWMutex
+	rules  []*aclRule
+	misses uint64 // peers matching no rule, accessed atomically
+}
+
+func loadACL(path string) (*acl, error) {
+	a := &acl{path: path}
+	rules, err := readACL(path)
+	if err != nil {
+		return nil, err
+	}
+	a.rules = rules
+	return a, nil
+}
+
+func readACL(path string) ([]*aclRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "readACL")
+	}
+	defer f.Close()
+	return parseACL(f)
+}
+
+func parseACL(r io.Reader) ([]*aclRule, error) {
+	var rules []*aclRule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("parseACL: line %v: malformed rule %q", n, line)
+		}
+
+		rule := &aclRule{text: line}
+		switch fields[0] {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return nil, errors.Errorf("parseACL: line %v: unknown action %q", n, fields[0])
+		}
+
+		cidr := fields[1]
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Errorf("parseACL: line %v: invalid address %q", n, fields[1])
+		}
+		rule.network = network
+		rules = append(rules, rule)
+	}
+	return rules, errors.Wrap(scanner.Err(), "parseACL")
+}
+
+// reload replaces the rules with the content of the file, the current
+// rules are kept if the file is invalid.
+func (a *acl) reload() {
+	rules, err := readACL(a.path)
+	if err != nil {
+		log.Println("acl: reload:", err)
+		return
+	}
+	a.mu.Lock()
+	a.rules = rules
+	a.mu.Unlock()
+	atomic.StoreUint64(&a.misses, 0)
+	log.Println("acl: reloaded", len(rules), "rules from", a.path)
+}
+
+// allowed tells whether the peer at addr may open sessions
+func (a *acl) allowed(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	hasAllow := false
+	for _, rule := range a.rules {
+		if ip != nil && rule.network.Contains(ip) {
+			atomic.AddUint64(&rule.hits, 1)
+			return rule.allow
+		}
+		hasAllow = hasAllow || rule.allow
+	}
+	atomic.AddUint64(&a.misses, 1)
+	return !hasAllow
+}
+
+// logStats prints the hits of every rule
+func (a *acl) logStats() {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.rules {
+		log.Printf("acl: %v hits:%v", rule.text, atomic.LoadUint64(&rule.hits))
+	}
+	log.Printf("acl: no match hits:%v", atomic.LoadUint64(&a.misses))
+}
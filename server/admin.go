@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serveAdmin serves the admin interface on addr, it has no authentication
+// and should listen on a loopback address:
+//
+//	GET  /quota                         usage of every user in the current period
+//	POST /quota?user=NAME&soft=MB&hard=MB  override the limits of a user, 0 for defaults
+//	POST /quota/reset?user=NAME         clear the usage of a user
+func serveAdmin(addr string, q *quotaStore) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/quota", func(w http.ResponseWriter, r *http.Request) {
+		if q == nil {
+			http.Error(w, "quota disabled", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			start, entries := q.usage()
+			writeJSON(w, struct {
+				Start time.Time    `json:"start"`
+				Users []quotaEntry `json:"users"`
+			}{start, entries})
+		case http.MethodPost:
+			user := r.FormValue("user")
+			soft, err1 := strconv.ParseInt(r.FormValue("soft"), 10, 64)
+			hard, err2 := strconv.ParseInt(r.FormValue("hard"), 10, 64)
+			if user == "" || err1 != nil || err2 != nil || soft < 0 || hard < 0 {
+				http.Error(w, "user, soft and hard are required", http.StatusBadRequest)
+				return
+			}
+			q.setLimits(user, soft<<20, hard<<20)
+			log.Println("quota: limits of", user, "set to soft:", soft, "hard:", hard)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/quota/reset", func(w http.ResponseWriter, r *http.Request) {
+		if q == nil {
+			http.Error(w, "quota disabled", http.StatusNotFound)
+			return
+		}
+		user := r.FormValue("user")
+		if r.Method != http.MethodPost || user == "" {
+			http.Error(w, "POST with a user is required", http.StatusBadRequest)
+			return
+		}
+		q.reset(user)
+		log.Println("quota: usage of", user, "reset")
+	})
+	log.Println("admin:", http.ListenAndServe(addr, mux))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Println("admin:", err)
+	}
+}
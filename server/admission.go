@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sweepInterval is how often the new session rates of idle sources are dropped
+const sweepInterval = time.Minute
+
+// admission bounds the sessions, streams and target dials clients can
+// take, so a misbehaving client is rejected instead of exhausting the
+// server, a limit of 0 is unlimited.
+type admission struct {
+	maxSessions      int
+	maxSessionsPerIP int
+	maxStreams       int32   // per session
+	newRate          float64 // new sessions per second per IP
+	dials            chan struct{}
+
+	mu        sync.Mutex
+	sessions  int
+	perIP     map[string]int
+	sources   map[string]*sourceRate
+	lastSweep time.Time
+
+	// rejections, accessed atomically
+	sessionsRejected uint64
+	streamsRejected  uint64
+	dialsRejected    uint64
+	floodRejected    uint64 // sessions over the new session rate
+	halfOpenClosed   uint64 // sessions closed without ever opening a stream
+}
+
+// sourceRate is a token bucket of new sessions for an IP, holding at most
+// one second worth of sessions.
+type sourceRate struct {
+	tokens float64
+	last   time.Time
+}
+
+func newAdmission(maxSessions, maxSessionsPerIP, maxStreams, maxDials, newRate int) *admission {
+	a := &admission{
+		maxSessions:      maxSessions,
+		maxSessionsPerIP: maxSessionsPerIP,
+		maxStreams:       int32(maxStreams),
+		newRate:          float64(newRate),
+		perIP:            make(map[string]int),
+		sources:          make(map[string]*sourceRate),
+		lastSweep:        time.Now(),
+	}
+	if maxDials > 0 {
+		a.dials = make(chan struct{}, maxDials)
+	}
+	return a
+}
+
+// hostOf returns the IP of a peer address, or the address itself
+func hostOf(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case *net.TCPAddr:
+		return addr.IP.String()
+	}
+	return addr.String()
+}
+
+// admitSession registers a session from ip, it returns why the session is
+// rejected or an empty string; a session admitted must be released with
+// releaseSession.
+func (a *admission) admitSession(ip string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.allowNew(ip) {
+		atomic.AddUint64(&a.floodRejected, 1)
+		return "too many new sessions"
+	}
+	if (a.maxSessions > 0 && a.sessions >= a.maxSessions) ||
+		(a.maxSessionsPerIP > 0 && a.perIP[ip] >= a.maxSessionsPerIP) {
+		atomic.AddUint64(&a.sessionsRejected, 1)
+		return "too many sessions"
+	}
+	a.sessions++
+	a.perIP[ip]++
+	return ""
+}
+
+// allowNew applies the new session rate of ip, the caller must hold a.mu
+func (a *admission) allowNew(ip string) bool {
+	if a.newRate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(a.lastSweep) > sweepInterval {
+		// a source idle for a second is back to a full bucket
+		for k, s := range a.sources {
+			if now.Sub(s.last) > time.Second {
+				delete(a.sources, k)
+			}
+		}
+		a.lastSweep = now
+	}
+
+	s, ok := a.sources[ip]
+	if !ok {
+		s = &sourceRate{tokens: a.newRate, last: now}
+		a.sources[ip] = s
+	}
+	s.tokens += now.Sub(s.last).Seconds() * a.newRate
+	if s.tokens > a.newRate {
+		s.tokens = a.newRate
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// halfOpen counts a session closed for never opening a stream
+func (a *admission) halfOpen() { atomic.AddUint64(&a.halfOpenClosed, 1) }
+
+func (a *admission) releaseSession(ip string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sessions--
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
+
+// admitStream counts a stream in the session's counter, an admitted
+// stream must be released by decrementing the counter.
+func (a *admission) admitStream(streams *int32) bool {
+	if n := atomic.AddInt32(streams, 1); a.maxStreams > 0 && n > a.maxStreams {
+		atomic.AddInt32(streams, -1)
+		atomic.AddUint64(&a.streamsRejected, 1)
+		return false
+	}
+	return true
+}
+
+// acquireDial takes a slot for dialing a target, without waiting, the slot
+// must be returned with releaseDial.
+func (a *admission) acquireDial() bool {
+	if a.dials == nil {
+		return true
+	}
+	select {
+	case a.dials <- struct{}{}:
+		return true
+	default:
+		atomic.AddUint64(&a.dialsRejected, 1)
+		return false
+	}
+}
+
+func (a *admission) releaseDial() {
+	if a.dials != nil {
+		<-a.dials
+	}
+}
+
+// logStats prints the current sessions and the rejections
+func (a *admission) logStats() {
+	a.mu.Lock()
+	sessions, ips := a.sessions, len(a.perIP)
+	a.mu.Unlock()
+	log.Printf("admission: sessions:%v ips:%v dials:%v rejected sessions:%v streams:%v dials:%v flood:%v halfopen:%v",
+		sessions, ips, len(a.dials),
+		atomic.LoadUint64(&a.sessionsRejected),
+		atomic.LoadUint64(&a.streamsRejected),
+		atomic.LoadUint64(&a.dialsRejected),
+		atomic.LoadUint64(&a.floodRejected),
+		atomic.LoadUint64(&a.halfOpenClosed))
+}
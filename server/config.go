@@ -3,34 +3,91 @@ package main
 import (
 	"encoding/json"
 	"os"
+
+	"github.com/shadowsocks/kcptun/generic"
 )
 
 // Config for server
 type Config struct {
-	Listen       string `json:"listen"`
-	Target       string `json:"target"`
-	Key          string `json:"key"`
-	Crypt        string `json:"crypt"`
-	Mode         string `json:"mode"`
-	MTU          int    `json:"mtu"`
-	SndWnd       int    `json:"sndwnd"`
-	RcvWnd       int    `json:"rcvwnd"`
-	DataShard    int    `json:"datashard"`
-	ParityShard  int    `json:"parityshard"`
-	DSCP         int    `json:"dscp"`
-	NoComp       bool   `json:"nocomp"`
-	AckNodelay   bool   `json:"acknodelay"`
-	NoDelay      int    `json:"nodelay"`
-	Interval     int    `json:"interval"`
-	Resend       int    `json:"resend"`
-	NoCongestion int    `json:"nc"`
-	SockBuf      int    `json:"sockbuf"`
-	KeepAlive    int    `json:"keepalive"`
-	Log          string `json:"log"`
-	SnmpLog      string `json:"snmplog"`
-	SnmpPeriod   int    `json:"snmpperiod"`
-	Pprof        bool   `json:"pprof"`
-	Quiet        bool   `json:"quiet"`
+	Listen           string `json:"listen"`
+	Target           string `json:"target"`
+	TargetLB         string `json:"targetlb"`
+	HealthCheck      int    `json:"healthcheck"`
+	MaxFails         int    `json:"maxfails"`
+	FailTimeout      int    `json:"failtimeout"`
+	DialTimeout      int    `json:"dialtimeout"`
+	MaxSessions      int    `json:"maxsessions"`
+	MaxSessionsPerIP int    `json:"maxsessionsperip"`
+	MaxStreams       int    `json:"maxstreams"`
+	MaxDials         int    `json:"maxdials"`
+	HandshakeRate    int    `json:"handshakerate"`
+	HandshakeTimeout int    `json:"handshaketimeout"`
+	StreamHdr        bool   `json:"streamhdr"`
+	ProxyProto       string `json:"proxyproto"`
+	ACL              string `json:"acl"`
+	Key              string `json:"key"`
+	Crypt            string `json:"crypt"`
+	Mode             string `json:"mode"`
+	MTU              int    `json:"mtu"`
+	PMTUD            bool   `json:"pmtud"`
+	SndWnd           int    `json:"sndwnd"`
+	RcvWnd           int    `json:"rcvwnd"`
+	CC               string `json:"cc"`
+	CCBandwidth      int    `json:"ccbandwidth"`
+	Pacing           bool   `json:"pacing"`
+	DataShard        int    `json:"datashard"`
+	ParityShard      int    `json:"parityshard"`
+	AdaptiveFEC      bool   `json:"adaptivefec"`
+	MinParity        int    `json:"minparity"`
+	MaxParity        int    `json:"maxparity"`
+	DSCP             int    `json:"dscp"`
+	NoComp           bool   `json:"nocomp"`
+	AckNodelay       bool   `json:"acknodelay"`
+	NoDelay          int    `json:"nodelay"`
+	Interval         int    `json:"interval"`
+	Resend           int    `json:"resend"`
+	NoCongestion     int    `json:"nc"`
+	SockBuf          int    `json:"sockbuf"`
+	KeepAlive        int    `json:"keepalive"`
+	CloseWait        int    `json:"closewait"`
+	StreamIdle       int    `json:"streamidle"`
+	StreamLife       int    `json:"streamlife"`
+	RateLimit        int    `json:"ratelimit"`
+	SessionRate      int    `json:"sessionrate"`
+	StreamRate       int    `json:"streamrate"`
+	AddrRate         int    `json:"addrrate"`
+	Quota            string `json:"quota"`
+	QuotaSoft        int    `json:"quotasoft"`
+	QuotaHard        int    `json:"quotahard"`
+	QuotaRate        int    `json:"quotarate"`
+	QuotaReset       string `json:"quotareset"`
+	QuotaUsers       string `json:"quotausers"`
+	Admin            string `json:"admin"`
+	Handover         string `json:"handover"`
+	Log              string `json:"log"`
+	SnmpLog          string `json:"snmplog"`
+	SnmpPeriod       int    `json:"snmpperiod"`
+	Pprof            bool   `json:"pprof"`
+	Quiet            bool   `json:"quiet"`
+
+	// Profiles are the tuning profiles selectable by mode
+	Profiles map[string]*generic.Profile `json:"profiles"`
+}
+
+// profileOptions returns the options of config set by tuning profiles
+func (config *Config) profileOptions() generic.Options {
+	return generic.Options{
+		NoDelay:      &config.NoDelay,
+		Interval:     &config.Interval,
+		Resend:       &config.Resend,
+		NoCongestion: &config.NoCongestion,
+		SndWnd:       &config.SndWnd,
+		RcvWnd:       &config.RcvWnd,
+		MTU:          &config.MTU,
+		DataShard:    &config.DataShard,
+		ParityShard:  &config.ParityShard,
+		AckNodelay:   &config.AckNodelay,
+	}
 }
 
 func parseJSONConfig(config *Config, path string) error {
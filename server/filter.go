@@ -0,0 +1,173 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/kcptun/generic"
+)
+
+const (
+	filterTimeout = 10 * time.Second // an admitted peer must show up as a session by then
+	filterSweep   = time.Second      // how often the peers which did not are released
+)
+
+// filterPeer is the admission state of a peer address
+type filterPeer struct {
+	host     string    // the admissions are counted by host
+	pending  bool      // admitted by a packet, the session not accepted yet
+	ts       time.Time // when pending was set
+	sessions int       // accepted sessions holding an admission
+}
+
+// peerFilter runs the ACL and the session admission on the packets of the
+// peers without a session, so a peer rejected is dropped before kcp
+// allocates a session for it. A peer admitted by its first packet holds an
+// admission until its session is accepted and released, or filterTimeout
+// passes without one.
+type peerFilter struct {
+	net.PacketConn
+	acl   *acl // may be nil
+	adm   *admission
+	quiet bool
+
+	mu        sync.Mutex
+	peers     map[string]*filterPeer
+	denied    map[string]bool // peers logged since the last sweep
+	lastSweep time.Time
+}
+
+func newPeerFilter(conn net.PacketConn, acl *acl, adm *admission, quiet bool) *peerFilter {
+	return &peerFilter{
+		PacketConn: conn,
+		acl:        acl,
+		adm:        adm,
+		quiet:      quiet,
+		peers:      make(map[string]*filterPeer),
+		denied:     make(map[string]bool),
+		lastSweep:  time.Now(),
+	}
+}
+
+// ReadFrom returns the packets of the peers admitted
+func (f *peerFilter) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := f.PacketConn.ReadFrom(b)
+		if err != nil || f.admit(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+// SetReadBuffer sets the receive buffer of the wrapped connection
+func (f *peerFilter) SetReadBuffer(bytes int) error {
+	return generic.SetReadBuffer(f.PacketConn, bytes)
+}
+
+// SetWriteBuffer sets the send buffer of the wrapped connection
+func (f *peerFilter) SetWriteBuffer(bytes int) error {
+	return generic.SetWriteBuffer(f.PacketConn, bytes)
+}
+
+// SetDSCP sets the DSCP of the wrapped connection
+func (f *peerFilter) SetDSCP(dscp int) error { return generic.SetDSCP(f.PacketConn, dscp) }
+
+// admit tells whether a packet from addr is passed on, a peer not known yet
+// takes an admission
+func (f *peerFilter) admit(addr net.Addr) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sweep()
+	if _, ok := f.peers[addr.String()]; ok {
+		return true
+	}
+	if !f.check(addr) {
+		return false
+	}
+	f.peers[addr.String()] = &filterPeer{host: hostOf(addr), pending: true, ts: time.Now()}
+	return true
+}
+
+// claim hands the admission of addr over to its accepted session, a peer
+// which lost it, or opens another session, is admitted again. A session
+// claimed must be released with release.
+func (f *peerFilter) claim(addr net.Addr) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.peers[addr.String()]
+	if ok && p.pending {
+		p.pending = false
+		p.sessions++
+		return true
+	}
+	if !f.check(addr) {
+		return false
+	}
+	if !ok {
+		p = &filterPeer{host: hostOf(addr)}
+		f.peers[addr.String()] = p
+	}
+	p.sessions++
+	return true
+}
+
+// release returns the admission of a session claimed
+func (f *peerFilter) release(addr net.Addr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.adm.releaseSession(hostOf(addr))
+	if p, ok := f.peers[addr.String()]; ok {
+		if p.sessions--; p.sessions <= 0 && !p.pending {
+			delete(f.peers, addr.String())
+		}
+	}
+}
+
+// check runs the ACL and the admission for addr, the caller must hold f.mu
+func (f *peerFilter) check(addr net.Addr) bool {
+	if f.acl != nil && !f.acl.allowed(addr) {
+		if f.logDenied(addr) {
+			log.Println("peer denied:", addr)
+		}
+		return false
+	}
+	if reason := f.adm.admitSession(hostOf(addr)); reason != "" {
+		if f.logDenied(addr) {
+			log.Println("session rejected:", addr, reason)
+		}
+		return false
+	}
+	return true
+}
+
+// logDenied tells whether a peer rejected is logged, once per sweep, the
+// caller must hold f.mu
+func (f *peerFilter) logDenied(addr net.Addr) bool {
+	if f.quiet || f.denied[addr.String()] {
+		return false
+	}
+	f.denied[addr.String()] = true
+	return true
+}
+
+// sweep releases the admissions of the peers which did not show up as a
+// session in time, the caller must hold f.mu
+func (f *peerFilter) sweep() {
+	now := time.Now()
+	if now.Sub(f.lastSweep) < filterSweep {
+		return
+	}
+	f.lastSweep = now
+	f.denied = make(map[string]bool)
+	for k, p := range f.peers {
+		if p.pending && now.Sub(p.ts) > filterTimeout {
+			p.pending = false
+			f.adm.releaseSession(p.host)
+		}
+		if !p.pending && p.sessions <= 0 {
+			delete(f.peers, k)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/kcptun/generic"
+)
+
+// Socket handover for zero-downtime upgrades:
+//
+// The running process listens on the --handover unix socket. A new process
+// started with the same --handover path connects to it and receives the UDP
+// socket, along with one end of a datagram socketpair and the addresses of
+// the sessions still served by the old process. From then on, only the new
+// process reads the UDP socket, packets from the old sessions are relayed to
+// the old process through the socketpair, while the old process drains its
+// sessions and exits. Both processes write to the UDP socket directly.
+//
+// A process handing over before the sessions it inherited are drained
+// passes them on along with its own, their packets then travel the chain
+// of relays back to the process owning them. The relays live as long as
+// the processes: once a process of the chain exits, the sessions inherited
+// through it are lost.
+
+const (
+	handoverVersion = 1
+	handoverTimeout = 5 * time.Second       // max time for a handover exchange
+	relayTimeout    = 10 * time.Millisecond // relayed packets are dropped past this
+)
+
+// relayConn is the packet conn under the kcp listener when --handover is set
+type relayConn struct {
+	*net.UDPConn
+
+	mu       sync.Mutex
+	peers    map[string]bool // sessions owned by the previous process
+	outbound *net.UnixConn   // relay to the previous process
+	inbound  *net.UnixConn   // relay from the next process, once handed over
+	msg      []byte          // buffer for the packets relayed to the previous process
+	relayed  []byte          // buffer for the packets relayed from the next process
+}
+
+func newRelayConn(conn *net.UDPConn) *relayConn {
+	return &relayConn{UDPConn: conn, msg: make([]byte, 64*1024), relayed: make([]byte, 64*1024)}
+}
+
+// listenRelay inherits the socket from the process serving on path, or
+// listens on addr when there is none.
+func listenRelay(path, addr string) (*relayConn, error) {
+	conn, err := inheritSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	if conn != nil {
+		log.Println("inherited socket:", conn.LocalAddr(), "sessions:", len(conn.peers))
+		return conn, nil
+	}
+
+	udpaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ResolveUDPAddr")
+	}
+	udpconn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenUDP")
+	}
+	return newRelayConn(udpconn), nil
+}
+
+// ReadFrom implements net.PacketConn, errors caused by the handover are
+// not returned, as they would stop the kcp listener.
+func (c *relayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		if in := c.getInbound(); in != nil {
+			return c.readRelayed(in, b)
+		}
+
+		n, addr, err := c.UDPConn.ReadFrom(b)
+		if err != nil {
+			if c.getInbound() != nil {
+				continue // woken up by the handover
+			}
+			return n, addr, err
+		}
+		if !c.relay(b[:n], addr) {
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *relayConn) getInbound() *net.UnixConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inbound
+}
+
+// relay forwards a packet of a session owned by the previous process
+func (c *relayConn) relay(p []byte, addr net.Addr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.outbound == nil || !c.peers[addr.String()] {
+		return false
+	}
+
+	saddr := addr.String()
+	msg := c.msg[:0]
+	msg = append(msg, byte(len(saddr)))
+	msg = append(msg, saddr...)
+	msg = append(msg, p...)
+	c.outbound.SetWriteDeadline(time.Now().Add(relayTimeout))
+	if _, err := c.outbound.Write(msg); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return true // the previous process is lagging, drop the packet
+		}
+		log.Println("previous process is gone, relay stopped:", err)
+		c.outbound.Close()
+		c.outbound = nil
+		c.peers = nil
+		return false
+	}
+	return true
+}
+
+// readRelayed reads a packet relayed from the next process, the packets of
+// sessions inherited from the previous process are relayed on to it.
+func (c *relayConn) readRelayed(in *net.UnixConn, b []byte) (int, net.Addr, error) {
+	for {
+		n, err := in.Read(c.relayed)
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "readRelayed")
+		}
+		if n < 1 || n < 1+int(c.relayed[0]) {
+			continue
+		}
+		l := int(c.relayed[0])
+		addr, err := net.ResolveUDPAddr("udp", string(c.relayed[1:1+l]))
+		if err != nil {
+			continue
+		}
+		if c.relay(c.relayed[1+l:n], addr) {
+			continue
+		}
+		return copy(b, c.relayed[1+l:n]), addr, nil
+	}
+}
+
+// inherited returns the sessions of the previous process still relayed
+func (c *relayConn) inherited() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.outbound == nil {
+		return nil
+	}
+	addrs := make([]string, 0, len(c.peers))
+	for addr := range c.peers {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// handover switches the reads to the relay from the next process
+func (c *relayConn) handover(in *net.UnixConn) {
+	c.mu.Lock()
+	c.inbound = in
+	c.mu.Unlock()
+	// wake up the pending read on the UDP socket
+	c.UDPConn.SetReadDeadline(time.Now())
+}
+
+// Close closes the socket and the relays
+func (c *relayConn) Close() error {
+	c.mu.Lock()
+	if c.inbound != nil {
+		c.inbound.Close()
+	}
+	if c.outbound != nil {
+		c.outbound.Close()
+		c.outbound = nil
+	}
+	c.mu.Unlock()
+	return c.UDPConn.Close()
+}
+
+// SetDSCP sets the DSCP of the socket, kcp only sets it on a *net.UDPConn
+func (c *relayConn) SetDSCP(dscp int) error { return generic.SetDSCP(c.UDPConn, dscp) }
@@ -0,0 +1,11 @@
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "github.com/pkg/errors"
+
+func inheritSocket(path string) (*relayConn, error) {
+	return nil, errors.New("socket handover is not supported on this platform")
+}
+
+func serveHandover(path string, conn *relayConn, g *graceful, onHandover func()) {}
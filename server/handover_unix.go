@@ -0,0 +1,158 @@
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// inheritSocket asks the process serving on path for its socket, it
+// returns nil when there is no such process.
+func inheritSocket(path string) (*relayConn, error) {
+	c, err := net.DialTimeout("unix", path, handoverTimeout)
+	if err != nil {
+		return nil, nil
+	}
+	defer c.Close()
+	uc := c.(*net.UnixConn)
+	uc.SetDeadline(time.Now().Add(handoverTimeout))
+
+	// the UDP socket and our end of the relay, followed by the sessions
+	var ver [1]byte
+	oob := make([]byte, syscall.CmsgSpace(2*4))
+	_, oobn, _, _, err := uc.ReadMsgUnix(ver[:], oob)
+	if err != nil {
+		return nil, errors.Wrap(err, "inheritSocket")
+	}
+	if ver[0] != handoverVersion {
+		return nil, errors.Errorf("inheritSocket: unsupported version %v", ver[0])
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, errors.New("inheritSocket: malformed control message")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "inheritSocket")
+	}
+	if len(fds) != 2 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, errors.Errorf("inheritSocket: expected 2 descriptors, got %v", len(fds))
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "udp")
+	pc, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, errors.Wrap(err, "net.FilePacketConn")
+	}
+	f = os.NewFile(uintptr(fds[1]), "relay")
+	rc, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		pc.Close()
+		return nil, errors.Wrap(err, "net.FileConn")
+	}
+
+	var addrs []string
+	if err := json.NewDecoder(uc).Decode(&addrs); err != nil {
+		pc.Close()
+		rc.Close()
+		return nil, errors.Wrap(err, "inheritSocket: sessions")
+	}
+
+	conn := newRelayConn(pc.(*net.UDPConn))
+	conn.outbound = rc.(*net.UnixConn)
+	conn.peers = make(map[string]bool)
+	for _, addr := range addrs {
+		conn.peers[addr] = true
+	}
+	return conn, nil
+}
+
+// serveHandover hands conn over to the first process connecting on path,
+// then calls onHandover to drain the sessions left to this process.
+func serveHandover(path string, conn *relayConn, g *graceful, onHandover func()) {
+	// the previous process, if any, is done with the path
+	os.Remove(path)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		log.Println("handover:", err)
+		return
+	}
+
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			log.Println("handover:", err)
+			return
+		}
+		// the sessions this process inherited are still relayed by it
+		err = sendSocket(c, conn, append(g.addrs(), conn.inherited()...))
+		c.Close()
+		if err != nil {
+			log.Println("handover:", err)
+			continue
+		}
+
+		// the next process owns the path now
+		l.SetUnlinkOnClose(false)
+		l.Close()
+		log.Println("socket handed over, draining sessions")
+		onHandover()
+		return
+	}
+}
+
+// sendSocket passes the UDP socket and one end of a new relay to the next
+// process, the other end receives the packets of the remaining sessions.
+func sendSocket(c *net.UnixConn, conn *relayConn, addrs []string) error {
+	c.SetDeadline(time.Now().Add(handoverTimeout))
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return errors.Wrap(err, "syscall.Socketpair")
+	}
+	f := os.NewFile(uintptr(fds[0]), "relay")
+	rc, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		syscall.Close(fds[1])
+		return errors.Wrap(err, "net.FileConn")
+	}
+	peer := os.NewFile(uintptr(fds[1]), "relay")
+	defer peer.Close()
+
+	raw, err := conn.UDPConn.SyscallConn()
+	if err != nil {
+		rc.Close()
+		return errors.Wrap(err, "SyscallConn")
+	}
+	var werr error
+	err = raw.Control(func(fd uintptr) {
+		rights := syscall.UnixRights(int(fd), fds[1])
+		_, _, werr = c.WriteMsgUnix([]byte{handoverVersion}, rights, nil)
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = json.NewEncoder(c).Encode(addrs)
+	}
+	if err != nil {
+		rc.Close()
+		return errors.Wrap(err, "sendSocket")
+	}
+
+	conn.handover(rc.(*net.UnixConn))
+	return nil
+}
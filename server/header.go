@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// stream header, written by the client as the first bytes of every stream
+// when --streamhdr is set, the client must be started with --streamhdr too.
+//
+// |  VER(1B)  |  CMD(1B)  |  LENGTH(2B)  |  FIELDS(LENGTH)  |
+//
+// FIELDS is a sequence of | TYPE(1B) | LEN(1B) | VALUE(LEN) |
+const (
+	hdrVersion = 1
+	hdrSize    = 4
+	hdrTimeout = 10 * time.Second // max time to wait for a stream header
+)
+
+const (
+	// cmdConnect opens a stream to the target
+	cmdConnect byte = iota + 1
+	// cmdPing asks the server to answer with a single byte, used to probe remotes
+	cmdPing
+	// cmdDrain tells the server no more streams will be opened on the session
+	cmdDrain
+	// cmdFin tells the peer a stream won't send more data, it is sent on a
+	// stream of its own, either way
+	cmdFin
+)
+
+const (
+	// fieldSource is the address of the original client, IP(4B or 16B) + PORT(2B)
+	fieldSource byte = iota + 1
+	// fieldDest is the address the original client connected to, same encoding
+	fieldDest
+	// fieldHalfClose asks for half-closes to be propagated with cmdFin, no value
+	fieldHalfClose
+	// fieldStream is the id of the stream a cmdFin refers to, 4B
+	fieldStream
+	// fieldUser is the name the client accounts its traffic to, up to 255B
+	fieldUser
+)
+
+// streamHeader is the decoded form of a stream header
+type streamHeader struct {
+	cmd       byte
+	src       *net.TCPAddr
+	dst       *net.TCPAddr
+	halfClose bool
+	stream    uint32
+	user      string
+}
+
+// readStreamHeader reads and decodes a stream header, unknown fields are skipped
+func readStreamHeader(r io.Reader) (*streamHeader, error) {
+	var hdr [hdrSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, errors.Wrap(err, "readStreamHeader")
+	}
+	if hdr[0] != hdrVersion {
+		return nil, errors.Errorf("readStreamHeader: unsupported version %v", hdr[0])
+	}
+
+	fields := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, errors.Wrap(err, "readStreamHeader")
+	}
+
+	h := &streamHeader{cmd: hdr[1]}
+	for len(fields) > 0 {
+		if len(fields) < 2 || len(fields) < 2+int(fields[1]) {
+			return nil, errors.New("readStreamHeader: malformed field")
+		}
+		typ, value := fields[0], fields[2:2+int(fields[1])]
+		fields = fields[2+len(value):]
+
+		switch typ {
+		case fieldSource:
+			h.src = parseAddrField(value)
+		case fieldDest:
+			h.dst = parseAddrField(value)
+		case fieldHalfClose:
+			h.halfClose = true
+		case fieldStream:
+			if len(value) == 4 {
+				h.stream = binary.BigEndian.Uint32(value)
+			}
+		case fieldUser:
+			h.user = string(value)
+		}
+	}
+	return h, nil
+}
+
+// writeFin sends a cmdFin header for the stream id
+func writeFin(w io.Writer, id uint32) error {
+	buf := []byte{hdrVersion, cmdFin, 0, 6, fieldStream, 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[6:], id)
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "writeFin")
+	}
+	return nil
+}
+
+// sendFin announces the end of data on the stream id
+func sendFin(sess *smux.Session, id uint32) error {
+	s, err := sess.OpenStream()
+	if err != nil {
+		return errors.Wrap(err, "sendFin")
+	}
+	defer s.Close()
+	return writeFin(s, id)
+}
+
+func parseAddrField(value []byte) *net.TCPAddr {
+	if len(value) != net.IPv4len+2 && len(value) != net.IPv6len+2 {
+		return nil
+	}
+	n := len(value) - 2
+	ip := make(net.IP, n)
+	copy(ip, value[:n])
+	return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(value[n:]))}
+}
@@ -12,6 +12,9 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/pbkdf2"
@@ -19,6 +22,8 @@ import (
 	"path/filepath"
 
 	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/kcptun/generic"
 	"github.com/urfave/cli"
 	kcp "github.com/xtaci/kcp-go"
 	"github.com/xtaci/smux"
@@ -29,6 +34,18 @@ var (
 	VERSION = "SELFBUILD"
 	// SALT is use for pbkdf2 key expansion
 	SALT = "kcp-go"
+	// limits are the rate limits, reloaded on SIGHUP and reported on SIGUSR1
+	limits *rateLimits
+	// peerACL filters kcp peers, reloaded on SIGHUP and reported on SIGUSR1
+	peerACL *acl
+	// admit bounds the resources taken by clients, reported on SIGUSR1
+	admit *admission
+	// quotas account the traffic of users, reported on SIGUSR1
+	quotas *quotaStore
+	// fecTotals are the adaptive FEC statistics, reported on SIGUSR1
+	fecTotals *generic.FECCounters
+	// paceTotals are the paced peers, reported on SIGUSR1
+	paceTotals *generic.PaceStats
 )
 
 type compStream struct {
@@ -59,8 +76,45 @@ func newCompStream(conn net.Conn) *compStream {
 	return c
 }
 
-// handle multiplex-ed connection
-func handleMux(conn io.ReadWriteCloser, config *Config) {
+// muxSession is the state of a kcp session shared by its streams
+type muxSession struct {
+	mux      *smux.Session
+	raddr    net.Addr
+	laddr    net.Addr
+	fins     *generic.FinTable
+	bucket   *bucket // rate limit of the session
+	streams  int32   // streams being handled, accessed atomically
+	draining int32   // set once the client announced no more streams, accessed atomically
+}
+
+// drain refuses the new streams of the session and closes it as soon as
+// its last stream is done
+func (s *muxSession) drain() {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return
+	}
+	log.Println("session draining:", s.raddr, "streams:", s.mux.NumStreams())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.mux.IsClosed() {
+			return
+		}
+		if s.mux.NumStreams() == 0 {
+			log.Println("session drained:", s.raddr)
+			s.mux.Close()
+			return
+		}
+	}
+}
+
+// sessionTask runs alongside a session until closed returns true
+type sessionTask func(closed func() bool)
+
+// handle multiplex-ed connection, the session must have been admitted
+func handleMux(conn io.ReadWriteCloser, raddr, laddr net.Addr, pool *targetPool, rl *rateLimits, adm *admission, pf *peerFilter, q *quotaStore, tasks []sessionTask, g *graceful, config *Config) {
+	defer pf.release(raddr)
+
 	// stream multiplex
 	smuxConfig := smux.DefaultConfig()
 	smuxConfig.MaxReceiveBuffer = config.SockBuf
@@ -72,43 +126,199 @@ func handleMux(conn io.ReadWriteCloser, config *Config) {
 		return
 	}
 	defer mux.Close()
+	g.track(mux, raddr)
+	defer g.untrack(mux)
+	for _, task := range tasks {
+		go task(mux.IsClosed)
+	}
+
+	// close sessions which never open a stream, clients with --streamhdr
+	// ping as soon as a session is up
+	var halfOpen *time.Timer
+	if config.StreamHdr && config.HandshakeTimeout > 0 {
+		halfOpen = time.AfterFunc(time.Duration(config.HandshakeTimeout)*time.Second, func() {
+			adm.halfOpen()
+			log.Println("session closed:", raddr, "no stream opened")
+			mux.Close()
+		})
+	}
+
+	sess := &muxSession{mux: mux, raddr: raddr, laddr: laddr, fins: generic.NewFinTable(), bucket: rl.newSessionBucket()}
 	for {
 		p1, err := mux.AcceptStream()
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		p2, err := net.DialTimeout("tcp", config.Target, 5*time.Second)
+		if halfOpen != nil {
+			halfOpen.Stop()
+			halfOpen = nil
+		}
+		go handleStream(p1, sess, pool, rl, adm, q, g, config)
+	}
+}
+
+// handleStream connects an accepted stream to a target, the commands of the
+// stream header are answered without counting against the limits of streams
+func handleStream(p1 *smux.Stream, sess *muxSession, pool *targetPool, rl *rateLimits, adm *admission, q *quotaStore, g *graceful, config *Config) {
+	src, dst := sess.raddr, sess.laddr
+	user := hostOf(sess.raddr)
+	var halfClose bool
+	if config.StreamHdr {
+		p1.SetReadDeadline(time.Now().Add(hdrTimeout))
+		hdr, err := readStreamHeader(p1)
 		if err != nil {
 			p1.Close()
 			log.Println(err)
-			continue
+			return
+		}
+		p1.SetReadDeadline(time.Time{})
+		switch hdr.cmd {
+		case cmdPing:
+			p1.Write([]byte{hdrVersion})
+			p1.Close()
+			return
+		case cmdDrain:
+			p1.Close()
+			sess.drain()
+			return
+		case cmdFin:
+			p1.Close()
+			sess.fins.Fin(hdr.stream)
+			return
+		}
+		halfClose = hdr.halfClose
+		if hdr.user != "" {
+			if q.known(hdr.user) {
+				user = hdr.user
+			} else if !config.Quiet {
+				log.Println("stream user ignored:", hdr.user, "not in --quotausers")
+			}
+		}
+		if hdr.src != nil {
+			src = hdr.src
+			if !config.Quiet {
+				log.Println("stream source:", src)
+			}
+		}
+		if hdr.dst != nil {
+			dst = hdr.dst
+		}
+	}
+
+	// no new streams on a draining session
+	if atomic.LoadInt32(&sess.draining) != 0 {
+		p1.Close()
+		if !config.Quiet {
+			log.Println("stream refused:", sess.raddr, "session draining")
+		}
+		return
+	}
+
+	// no new streams once shutting down
+	if !g.add() {
+		p1.Close()
+		return
+	}
+	defer g.done()
+	if !adm.admitStream(&sess.streams) {
+		p1.Close()
+		if !config.Quiet {
+			log.Println("stream rejected:", sess.raddr, "too many streams")
+		}
+		return
+	}
+	defer atomic.AddInt32(&sess.streams, -1)
+
+	// streams from the same client host stick to a target with the hash strategy
+	key := src.String()
+	if addr := toTCPAddr(src); addr != nil {
+		key = addr.IP.String()
+	}
+	qu := q.user(user)
+	if !q.allowed(qu) {
+		p1.Close()
+		log.Println("stream refused:", user, "quota exceeded")
+		return
+	}
+
+	if !adm.acquireDial() {
+		p1.Close()
+		if !config.Quiet {
+			log.Println("stream rejected:", src, "too many dials")
+		}
+		return
+	}
+	p2, err := pool.dial(key, time.Duration(config.DialTimeout)*time.Second)
+	adm.releaseDial()
+	if err != nil {
+		p1.Close()
+		log.Println(err)
+		return
+	}
+
+	if config.ProxyProto != "" {
+		if err := writeProxyHeader(p2, config.ProxyProto, src, dst); err != nil {
+			p1.Close()
+			p2.Close()
+			log.Println(err)
+			return
+		}
+	}
+
+	// the session, stream and client address buckets on top of the global
+	// one, the client address is the kcp peer's as the source of the stream
+	// header is told by the client
+	peer := hostOf(sess.raddr)
+	addrBucket := rl.acquireAddr(peer)
+	defer rl.releaseAddr(peer)
+	buckets := []*bucket{sess.bucket, rl.newStreamBucket(), addrBucket}
+
+	watch := generic.NewStreamWatch(time.Duration(config.StreamIdle)*time.Second, time.Duration(config.StreamLife)*time.Second)
+	defer watch.Stop()
+	w1 := watch.Writer(q.writer(rl.writer(p1, buckets...), qu))
+	w2 := watch.Writer(q.writer(rl.writer(p2, buckets...), qu))
+	if halfClose {
+		if !config.Quiet {
+			log.Println("stream opened", "halfclose: true")
+		}
+		defer p1.Close()
+		defer p2.Close()
+		reason := generic.HalfCloseCopy(p1, p2, w1, w2, watch, sess.fins, func(id uint32) error { return sendFin(sess.mux, id) })
+		if !config.Quiet || generic.TimedOut(reason) {
+			log.Println("stream closed", "source:", src, "reason:", reason)
 		}
-		go handleClient(p1, p2, config.Quiet)
+		return
 	}
+	handleClient(p1, p2, w1, w2, src, watch, config.Quiet)
 }
 
-func handleClient(p1, p2 io.ReadWriteCloser, quiet bool) {
+// handleClient relays between p1 and p2, writing through w1 and w2
+func handleClient(p1, p2 io.ReadWriteCloser, w1, w2 io.Writer, src net.Addr, watch *generic.StreamWatch, quiet bool) {
 	if !quiet {
 		log.Println("stream opened")
-		defer log.Println("stream closed")
 	}
 	defer p1.Close()
 	defer p2.Close()
 
 	// start tunnel
 	p1die := make(chan struct{})
-	buf1 := make([]byte, 65535)
-	go func() { io.CopyBuffer(p1, p2, buf1); close(p1die) }()
+	go func() { generic.CopyBuffer(w1, p2); close(p1die) }()
 
 	p2die := make(chan struct{})
-	buf2 := make([]byte, 65535)
-	go func() { io.CopyBuffer(p2, p1, buf2); close(p2die) }()
+	go func() { generic.CopyBuffer(w2, p1); close(p2die) }()
 
 	// wait for tunnel termination
+	var reason string
 	select {
 	case <-p1die:
+		reason = "target closed"
 	case <-p2die:
+		reason = "client closed"
+	case reason = <-watch.Reason:
+	}
+	if !quiet || generic.TimedOut(reason) {
+		log.Println("stream closed", "source:", src, "reason:", reason)
 	}
 }
 
@@ -138,7 +348,76 @@ func main() {
 		cli.StringFlag{
 			Name:  "target, t",
 			Value: "127.0.0.1:12948",
-			Usage: "target server address",
+			Usage: "target server address, or unix:/path for a unix domain socket, separate multiple targets by comma",
+		},
+		cli.StringFlag{
+			Name:  "targetlb",
+			Value: "rr",
+			Usage: "load balancing among multiple targets: rr, leastconn, hash",
+		},
+		cli.IntFlag{
+			Name:  "healthcheck",
+			Value: 0,
+			Usage: "seconds between active health checks of targets, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "maxfails",
+			Value: 3,
+			Usage: "consecutive dial failures before a target is ejected, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "failtimeout",
+			Value: 30,
+			Usage: "seconds an ejected target stays out of rotation",
+		},
+		cli.IntFlag{
+			Name:  "dialtimeout",
+			Value: 5,
+			Usage: "seconds to wait for a connection to the target",
+		},
+		cli.IntFlag{
+			Name:  "maxsessions",
+			Value: 0,
+			Usage: "maximum number of kcp sessions, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "maxsessionsperip",
+			Value: 0,
+			Usage: "maximum number of kcp sessions from a single IP, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "maxstreams",
+			Value: 0,
+			Usage: "maximum number of streams per session, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "maxdials",
+			Value: 0,
+			Usage: "maximum number of concurrent target dials, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "handshakerate",
+			Value: 0,
+			Usage: "new sessions per second allowed from a single IP, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "handshaketimeout",
+			Value: int(hdrTimeout / time.Second),
+			Usage: "seconds a session may stay without opening a stream before it is closed, applies with --streamhdr as the clients ping new sessions, 0 to disable",
+		},
+		cli.BoolFlag{
+			Name:  "streamhdr",
+			Usage: "read the stream header sent by clients started with --streamhdr",
+		},
+		cli.StringFlag{
+			Name:  "proxyproto",
+			Value: "",
+			Usage: "send a PROXY protocol header to the target: v1, v2, empty to disable",
+		},
+		cli.StringFlag{
+			Name:  "acl",
+			Value: "",
+			Usage: "file of allow/deny rules for kcp peer addresses, one \"allow|deny CIDR\" per line, reloaded on SIGHUP",
 		},
 		cli.StringFlag{
 			Name:   "key",
@@ -154,13 +433,17 @@ func main() {
 		cli.StringFlag{
 			Name:  "mode",
 			Value: "fast",
-			Usage: "profiles: fast3, fast2, fast, normal, manual",
+			Usage: "profiles: fast3, fast2, fast, normal, manual, auto, or a profile of the config file",
 		},
 		cli.IntFlag{
 			Name:  "mtu",
 			Value: 1350,
 			Usage: "set maximum transmission unit for UDP packets",
 		},
+		cli.BoolFlag{
+			Name:  "pmtud",
+			Usage: "discover the path mtu by probing with the DF bit set, --mtu is used when probing fails, must be set on both sides",
+		},
 		cli.IntFlag{
 			Name:  "sndwnd",
 			Value: 1024,
@@ -171,6 +454,20 @@ func main() {
 			Value: 1024,
 			Usage: "set receive window size(num of packets)",
 		},
+		cli.StringFlag{
+			Name:  "cc",
+			Value: "kcp",
+			Usage: "congestion control: kcp (set by nc), bbr, fair (bbr capped to a fair share of --ccbandwidth), bbr and fair pace the packets of each session",
+		},
+		cli.IntFlag{
+			Name:  "ccbandwidth",
+			Value: 0,
+			Usage: "bandwidth in bytes per second shared evenly among the sessions by the fair congestion control",
+		},
+		cli.BoolFlag{
+			Name:  "pacing",
+			Usage: "pace the packets of each session at its estimated bandwidth instead of flushing the send window in bursts, implied by --cc bbr and fair",
+		},
 		cli.IntFlag{
 			Name:  "datashard,ds",
 			Value: 10,
@@ -181,6 +478,20 @@ func main() {
 			Value: 3,
 			Usage: "set reed-solomon erasure coding - parityshard",
 		},
+		cli.BoolFlag{
+			Name:  "adaptivefec",
+			Usage: "tune the parity shards to the measured loss, --datashard and --parityshard become the initial ratio, must be set on both sides",
+		},
+		cli.IntFlag{
+			Name:  "minparity",
+			Value: 0,
+			Usage: "lowest parity shards of the adaptive fec",
+		},
+		cli.IntFlag{
+			Name:  "maxparity",
+			Value: 10,
+			Usage: "highest parity shards of the adaptive fec",
+		},
 		cli.IntFlag{
 			Name:  "dscp",
 			Value: 0,
@@ -225,6 +536,81 @@ func main() {
 			Value: 10, // nat keepalive interval in seconds
 			Usage: "seconds between heartbeats",
 		},
+		cli.IntFlag{
+			Name:  "closewait",
+			Value: 30,
+			Usage: "seconds to wait for streams to finish on SIGTERM",
+		},
+		cli.IntFlag{
+			Name:  "streamidle",
+			Value: 0,
+			Usage: "seconds a stream may stay without traffic before it is closed, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "streamlife",
+			Value: 0,
+			Usage: "maximum lifetime of a stream in seconds, 0 to disable",
+		},
+		cli.IntFlag{
+			Name:  "ratelimit",
+			Value: 0,
+			Usage: "total bandwidth limit in bytes per second, both directions, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "sessionrate",
+			Value: 0,
+			Usage: "bandwidth limit per session in bytes per second, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "streamrate",
+			Value: 0,
+			Usage: "bandwidth limit per stream in bytes per second, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "addrrate",
+			Value: 0,
+			Usage: "bandwidth limit per client IP in bytes per second, shared by every session from it, 0 for unlimited",
+		},
+		cli.StringFlag{
+			Name:  "quota",
+			Value: "",
+			Usage: "json file accounting the traffic of every user, users are named by the client --user if listed in --quotausers or by the client IP, empty to disable",
+		},
+		cli.IntFlag{
+			Name:  "quotasoft",
+			Value: 0,
+			Usage: "traffic per user and period in MB past which the user is throttled to --quotarate, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "quotahard",
+			Value: 0,
+			Usage: "traffic per user and period in MB past which new streams are refused, 0 for unlimited",
+		},
+		cli.IntFlag{
+			Name:  "quotarate",
+			Value: 0,
+			Usage: "bandwidth in bytes per second of a user past the soft quota, 0 for unlimited",
+		},
+		cli.StringFlag{
+			Name:  "quotareset",
+			Value: "monthly",
+			Usage: "quota period: daily, weekly, monthly",
+		},
+		cli.StringFlag{
+			Name:  "quotausers",
+			Value: "",
+			Usage: "comma separated names the clients may account their traffic to with --user, other names are accounted to the client IP",
+		},
+		cli.StringFlag{
+			Name:  "admin",
+			Value: "",
+			Usage: "admin interface listen address, eg. 127.0.0.1:6061, empty to disable",
+		},
+		cli.StringFlag{
+			Name:  "handover",
+			Value: "",
+			Usage: "unix socket path to hand the listening socket over to a new process on upgrade, the new process takes the same flag",
+		},
 		cli.StringFlag{
 			Name:  "snmplog",
 			Value: "",
@@ -254,19 +640,53 @@ func main() {
 			Usage: "config from json file, which will override the command from shell",
 		},
 	}
+	myApp.Commands = []cli.Command{
+		{
+			Name:  "profiles",
+			Usage: "print the built-in tuning profiles and those of the config file",
+			Action: func(c *cli.Context) error {
+				var config Config
+				if path := c.GlobalString("c"); path != "" {
+					checkError(parseJSONConfig(&config, path))
+				}
+				return generic.PrintProfiles(config.Profiles)
+			},
+		},
+	}
 	myApp.Action = func(c *cli.Context) error {
 		config := Config{}
 
 		config.Listen = c.String("listen")
 		config.Target = c.String("target")
+		config.TargetLB = c.String("targetlb")
+		config.HealthCheck = c.Int("healthcheck")
+		config.MaxFails = c.Int("maxfails")
+		config.FailTimeout = c.Int("failtimeout")
+		config.DialTimeout = c.Int("dialtimeout")
+		config.MaxSessions = c.Int("maxsessions")
+		config.MaxSessionsPerIP = c.Int("maxsessionsperip")
+		config.MaxStreams = c.Int("maxstreams")
+		config.MaxDials = c.Int("maxdials")
+		config.HandshakeRate = c.Int("handshakerate")
+		config.HandshakeTimeout = c.Int("handshaketimeout")
+		config.StreamHdr = c.Bool("streamhdr")
+		config.ProxyProto = c.String("proxyproto")
+		config.ACL = c.String("acl")
 		config.Key = c.String("key")
 		config.Crypt = c.String("crypt")
 		config.Mode = c.String("mode")
 		config.MTU = c.Int("mtu")
+		config.PMTUD = c.Bool("pmtud")
 		config.SndWnd = c.Int("sndwnd")
 		config.RcvWnd = c.Int("rcvwnd")
+		config.CC = c.String("cc")
+		config.CCBandwidth = c.Int("ccbandwidth")
+		config.Pacing = c.Bool("pacing")
 		config.DataShard = c.Int("datashard")
 		config.ParityShard = c.Int("parityshard")
+		config.AdaptiveFEC = c.Bool("adaptivefec")
+		config.MinParity = c.Int("minparity")
+		config.MaxParity = c.Int("maxparity")
 		config.DSCP = c.Int("dscp")
 		config.NoComp = c.Bool("nocomp")
 		config.AckNodelay = c.Bool("acknodelay")
@@ -276,6 +696,21 @@ func main() {
 		config.NoCongestion = c.Int("nc")
 		config.SockBuf = c.Int("sockbuf")
 		config.KeepAlive = c.Int("keepalive")
+		config.CloseWait = c.Int("closewait")
+		config.StreamIdle = c.Int("streamidle")
+		config.StreamLife = c.Int("streamlife")
+		config.RateLimit = c.Int("ratelimit")
+		config.SessionRate = c.Int("sessionrate")
+		config.StreamRate = c.Int("streamrate")
+		config.AddrRate = c.Int("addrrate")
+		config.Quota = c.String("quota")
+		config.QuotaSoft = c.Int("quotasoft")
+		config.QuotaHard = c.Int("quotahard")
+		config.QuotaRate = c.Int("quotarate")
+		config.QuotaReset = c.String("quotareset")
+		config.QuotaUsers = c.String("quotausers")
+		config.Admin = c.String("admin")
+		config.Handover = c.String("handover")
 		config.Log = c.String("log")
 		config.SnmpLog = c.String("snmplog")
 		config.SnmpPeriod = c.Int("snmpperiod")
@@ -296,6 +731,70 @@ func main() {
 			if c, b := opts.Get("target"); b {
 				config.Target = c
 			}
+			if c, b := opts.Get("targetlb"); b {
+				config.TargetLB = c
+			}
+			if c, b := opts.Get("healthcheck"); b {
+				if healthcheck, err := strconv.Atoi(c); err == nil {
+					config.HealthCheck = healthcheck
+				}
+			}
+			if c, b := opts.Get("maxfails"); b {
+				if maxfails, err := strconv.Atoi(c); err == nil {
+					config.MaxFails = maxfails
+				}
+			}
+			if c, b := opts.Get("failtimeout"); b {
+				if failtimeout, err := strconv.Atoi(c); err == nil {
+					config.FailTimeout = failtimeout
+				}
+			}
+			if c, b := opts.Get("dialtimeout"); b {
+				if dialtimeout, err := strconv.Atoi(c); err == nil {
+					config.DialTimeout = dialtimeout
+				}
+			}
+			if c, b := opts.Get("maxsessions"); b {
+				if maxsessions, err := strconv.Atoi(c); err == nil {
+					config.MaxSessions = maxsessions
+				}
+			}
+			if c, b := opts.Get("maxsessionsperip"); b {
+				if maxsessionsperip, err := strconv.Atoi(c); err == nil {
+					config.MaxSessionsPerIP = maxsessionsperip
+				}
+			}
+			if c, b := opts.Get("maxstreams"); b {
+				if maxstreams, err := strconv.Atoi(c); err == nil {
+					config.MaxStreams = maxstreams
+				}
+			}
+			if c, b := opts.Get("maxdials"); b {
+				if maxdials, err := strconv.Atoi(c); err == nil {
+					config.MaxDials = maxdials
+				}
+			}
+			if c, b := opts.Get("handshakerate"); b {
+				if handshakerate, err := strconv.Atoi(c); err == nil {
+					config.HandshakeRate = handshakerate
+				}
+			}
+			if c, b := opts.Get("handshaketimeout"); b {
+				if handshaketimeout, err := strconv.Atoi(c); err == nil {
+					config.HandshakeTimeout = handshaketimeout
+				}
+			}
+			if c, b := opts.Get("streamhdr"); b {
+				if streamhdr, err := strconv.ParseBool(c); err == nil {
+					config.StreamHdr = streamhdr
+				}
+			}
+			if c, b := opts.Get("proxyproto"); b {
+				config.ProxyProto = c
+			}
+			if c, b := opts.Get("acl"); b {
+				config.ACL = c
+			}
 			if c, b := opts.Get("key"); b {
 				config.Key = c
 			}
@@ -310,6 +809,11 @@ func main() {
 					config.MTU = mtu
 				}
 			}
+			if c, b := opts.Get("pmtud"); b {
+				if pmtud, err := strconv.ParseBool(c); err == nil {
+					config.PMTUD = pmtud
+				}
+			}
 			if c, b := opts.Get("sndwnd"); b {
 				if sndwnd, err := strconv.Atoi(c); err == nil {
 					config.SndWnd = sndwnd
@@ -320,6 +824,19 @@ func main() {
 					config.RcvWnd = rcvwnd
 				}
 			}
+			if c, b := opts.Get("cc"); b {
+				config.CC = c
+			}
+			if c, b := opts.Get("ccbandwidth"); b {
+				if ccbandwidth, err := strconv.Atoi(c); err == nil {
+					config.CCBandwidth = ccbandwidth
+				}
+			}
+			if c, b := opts.Get("pacing"); b {
+				if pacing, err := strconv.ParseBool(c); err == nil {
+					config.Pacing = pacing
+				}
+			}
 			if c, b := opts.Get("datashard"); b {
 				if datashard, err := strconv.Atoi(c); err == nil {
 					config.DataShard = datashard
@@ -330,6 +847,21 @@ func main() {
 					config.ParityShard = parityshard
 				}
 			}
+			if c, b := opts.Get("adaptivefec"); b {
+				if adaptivefec, err := strconv.ParseBool(c); err == nil {
+					config.AdaptiveFEC = adaptivefec
+				}
+			}
+			if c, b := opts.Get("minparity"); b {
+				if minparity, err := strconv.Atoi(c); err == nil {
+					config.MinParity = minparity
+				}
+			}
+			if c, b := opts.Get("maxparity"); b {
+				if maxparity, err := strconv.Atoi(c); err == nil {
+					config.MaxParity = maxparity
+				}
+			}
 			if c, b := opts.Get("dscp"); b {
 				if dscp, err := strconv.Atoi(c); err == nil {
 					config.DSCP = dscp
@@ -375,6 +907,71 @@ func main() {
 					config.KeepAlive = keepalive
 				}
 			}
+			if c, b := opts.Get("closewait"); b {
+				if closewait, err := strconv.Atoi(c); err == nil {
+					config.CloseWait = closewait
+				}
+			}
+			if c, b := opts.Get("streamidle"); b {
+				if streamidle, err := strconv.Atoi(c); err == nil {
+					config.StreamIdle = streamidle
+				}
+			}
+			if c, b := opts.Get("streamlife"); b {
+				if streamlife, err := strconv.Atoi(c); err == nil {
+					config.StreamLife = streamlife
+				}
+			}
+			if c, b := opts.Get("ratelimit"); b {
+				if ratelimit, err := strconv.Atoi(c); err == nil {
+					config.RateLimit = ratelimit
+				}
+			}
+			if c, b := opts.Get("sessionrate"); b {
+				if sessionrate, err := strconv.Atoi(c); err == nil {
+					config.SessionRate = sessionrate
+				}
+			}
+			if c, b := opts.Get("streamrate"); b {
+				if streamrate, err := strconv.Atoi(c); err == nil {
+					config.StreamRate = streamrate
+				}
+			}
+			if c, b := opts.Get("addrrate"); b {
+				if addrrate, err := strconv.Atoi(c); err == nil {
+					config.AddrRate = addrrate
+				}
+			}
+			if c, b := opts.Get("quota"); b {
+				config.Quota = c
+			}
+			if c, b := opts.Get("quotasoft"); b {
+				if quotasoft, err := strconv.Atoi(c); err == nil {
+					config.QuotaSoft = quotasoft
+				}
+			}
+			if c, b := opts.Get("quotahard"); b {
+				if quotahard, err := strconv.Atoi(c); err == nil {
+					config.QuotaHard = quotahard
+				}
+			}
+			if c, b := opts.Get("quotarate"); b {
+				if quotarate, err := strconv.Atoi(c); err == nil {
+					config.QuotaRate = quotarate
+				}
+			}
+			if c, b := opts.Get("quotareset"); b {
+				config.QuotaReset = c
+			}
+			if c, b := opts.Get("quotausers"); b {
+				config.QuotaUsers = c
+			}
+			if c, b := opts.Get("admin"); b {
+				config.Admin = c
+			}
+			if c, b := opts.Get("handover"); b {
+				config.Handover = c
+			}
 			if c, b := opts.Get("log"); b {
 				config.Log = c
 			}
@@ -406,17 +1003,50 @@ func main() {
 			log.SetOutput(f)
 		}
 
-		switch config.Mode {
-		case "normal":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
-		case "fast":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
-		case "fast2":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
-		case "fast3":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+		// auto starts as fast, then is tuned per session by generic.AutoTuner
+		mode, err := generic.LookupProfile(config.Mode, config.Profiles)
+		checkError(err)
+		mode.Apply(config.profileOptions())
+
+		var newCC generic.CCFactory
+		if config.CC != "kcp" {
+			newCC, err = generic.NewCCFactory(config.CC, config.CCBandwidth)
+			checkError(err)
+			// the controller replaces the congestion control of kcp
+			config.NoCongestion = 1
+		} else if config.Pacing {
+			// kcp keeps its congestion control, only the packets are paced
+			newCC = generic.NewPacing
+		}
+
+		switch config.ProxyProto {
+		case "", "v1", "v2":
+		default:
+			checkError(errors.Errorf("unsupported PROXY protocol version: %v", config.ProxyProto))
 		}
 
+		if config.ACL != "" {
+			peerACL, err = loadACL(config.ACL)
+			checkError(err)
+		}
+
+		adm := newAdmission(config.MaxSessions, config.MaxSessionsPerIP, config.MaxStreams, config.MaxDials, config.HandshakeRate)
+		admit = adm
+
+		var q *quotaStore
+		if config.Quota != "" {
+			q, err = newQuotaStore(config.Quota, int64(config.QuotaSoft)<<20, int64(config.QuotaHard)<<20, int64(config.QuotaRate), config.QuotaReset, strings.Split(config.QuotaUsers, ","))
+			checkError(err)
+			quotas = q
+		}
+
+		rl := newRateLimits(config.RateLimit, config.SessionRate, config.StreamRate, config.AddrRate)
+		rl.path = c.String("c")
+		limits = rl
+
+		pool, err := newTargetPool(config.Target, config.TargetLB, config.MaxFails, time.Duration(config.FailTimeout)*time.Second)
+		checkError(err)
+
 		log.Println("version:", VERSION)
 		log.Println("initiating key derivation")
 		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
@@ -451,26 +1081,100 @@ func main() {
 			block, _ = kcp.NewAESBlockCrypt(pass)
 		}
 
-		lis, err := kcp.ListenWithOptions(config.Listen, block, config.DataShard, config.ParityShard)
+		var lis *kcp.Listener
+		var relay *relayConn
+		var conn net.PacketConn
+		if config.Handover != "" {
+			relay, err = listenRelay(config.Handover, config.Listen)
+			checkError(err)
+			conn = relay
+		} else {
+			conn, err = net.ListenPacket("udp", config.Listen)
+			checkError(err)
+		}
+		// peers are denied or rejected before kcp allocates their session
+		pf := newPeerFilter(conn, peerACL, adm, config.Quiet)
+		conn = pf
+		var pm *generic.PMTUConn
+		if config.PMTUD {
+			pm = generic.NewPMTUConn(conn)
+			conn = pm
+		}
+		var pc *generic.PaceConn
+		if newCC != nil {
+			paceTotals = generic.NewPaceStats()
+			pc = generic.NewPaceConn(conn, paceTotals)
+			conn = pc
+		}
+		dataShards, parityShards, overhead := config.DataShard, config.ParityShard, 0
+		var fc *generic.FECConn
+		if config.AdaptiveFEC {
+			// the shards are handled by the FEC connection, kcp runs without FEC
+			var fec *generic.FECParams
+			fec, err = generic.NewFECParams(config.DataShard, config.ParityShard, config.MinParity, config.MaxParity)
+			checkError(err)
+			fecTotals = fec.Stats
+			fc = generic.NewFECConn(conn, *fec)
+			conn = fc
+			dataShards, parityShards, overhead = 0, 0, generic.FECOverhead
+		}
+		mtu := config.MTU - overhead
+		lis, err = kcp.ServeConn(block, dataShards, parityShards, conn)
 		checkError(err)
 		log.Println("listening on:", lis.Addr())
 		log.Println("target:", config.Target)
+		log.Println("targetlb:", config.TargetLB)
+		log.Println("healthcheck:", config.HealthCheck)
+		log.Println("maxfails:", config.MaxFails, "failtimeout:", config.FailTimeout)
+		log.Println("dialtimeout:", config.DialTimeout)
+		log.Println("maxsessions:", config.MaxSessions)
+		log.Println("maxsessionsperip:", config.MaxSessionsPerIP)
+		log.Println("maxstreams:", config.MaxStreams)
+		log.Println("maxdials:", config.MaxDials)
+		log.Println("handshakerate:", config.HandshakeRate)
+		log.Println("handshaketimeout:", config.HandshakeTimeout)
 		log.Println("encryption:", config.Crypt)
+		log.Println("streamhdr:", config.StreamHdr)
+		log.Println("proxyproto:", config.ProxyProto)
+		log.Println("acl:", config.ACL)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
+		log.Println("cc:", config.CC)
+		log.Println("ccbandwidth:", config.CCBandwidth)
+		log.Println("pacing:", config.Pacing)
 		log.Println("compression:", !config.NoComp)
 		log.Println("mtu:", config.MTU)
+		log.Println("pmtud:", config.PMTUD)
 		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
+		log.Println("adaptivefec:", config.AdaptiveFEC)
+		log.Println("minparity:", config.MinParity)
+		log.Println("maxparity:", config.MaxParity)
 		log.Println("acknodelay:", config.AckNodelay)
 		log.Println("dscp:", config.DSCP)
 		log.Println("sockbuf:", config.SockBuf)
 		log.Println("keepalive:", config.KeepAlive)
+		log.Println("closewait:", config.CloseWait)
+		log.Println("streamidle:", config.StreamIdle)
+		log.Println("streamlife:", config.StreamLife)
+		log.Println("ratelimit:", config.RateLimit)
+		log.Println("sessionrate:", config.SessionRate)
+		log.Println("streamrate:", config.StreamRate)
+		log.Println("addrrate:", config.AddrRate)
+		log.Println("quota:", config.Quota)
+		log.Println("quotasoft:", config.QuotaSoft)
+		log.Println("quotahard:", config.QuotaHard)
+		log.Println("quotarate:", config.QuotaRate)
+		log.Println("quotareset:", config.QuotaReset)
+		log.Println("quotausers:", config.QuotaUsers)
+		log.Println("admin:", config.Admin)
+		log.Println("handover:", config.Handover)
 		log.Println("snmplog:", config.SnmpLog)
 		log.Println("snmpperiod:", config.SnmpPeriod)
 		log.Println("pprof:", config.Pprof)
 		log.Println("quiet:", config.Quiet)
 
-		if err := lis.SetDSCP(config.DSCP); err != nil {
+		// kcp can't set the DSCP through the wrappers of its socket
+		if err := generic.SetDSCP(conn, config.DSCP); err != nil {
 			log.Println("SetDSCP:", err)
 		}
 		if err := lis.SetReadBuffer(config.SockBuf); err != nil {
@@ -481,25 +1185,99 @@ func main() {
 		}
 
 		go snmpLogger(config.SnmpLog, config.SnmpPeriod)
+		go pool.healthCheck(config.HealthCheck, time.Duration(config.DialTimeout)*time.Second)
 		if config.Pprof {
 			go http.ListenAndServe(":6060", nil)
 		}
+		if q != nil {
+			go q.run()
+		}
+		if config.Admin != "" {
+			go serveAdmin(config.Admin, q)
+		}
 		go parentMonitor(3)
 
+		// on SIGTERM or handover, stop accepting and wait for the streams to finish
+		g := newGraceful()
+		var once sync.Once
+		shutdown := func() {
+			once.Do(func() {
+				g.shutdown()
+				log.Println("waiting for streams to finish:", g.inflight())
+				drained := g.wait(time.Duration(config.CloseWait) * time.Second)
+				g.closeSessions()
+				if q != nil {
+					if err := q.save(); err != nil {
+						log.Println(err)
+					}
+				}
+				// sessions share the listener's socket, close it last
+				lis.Close()
+				if relay != nil {
+					relay.Close()
+				}
+				if !drained {
+					log.Println("shutdown deadline reached, streams left:", g.inflight())
+					os.Exit(1)
+				}
+				log.Println("all streams finished")
+				os.Exit(0)
+			})
+		}
+		notifyShutdown(shutdown)
+		if relay != nil {
+			go serveHandover(config.Handover, relay, g, shutdown)
+		}
+
 		for {
 			if conn, err := lis.AcceptKCP(); err == nil {
+				select {
+				case <-g.die:
+					conn.Close()
+					continue
+				default:
+				}
+
+				// the admission taken by the first packet of the peer
+				if !pf.claim(conn.RemoteAddr()) {
+					conn.Close()
+					continue
+				}
+
 				log.Println("remote address:", conn.RemoteAddr())
 				conn.SetStreamMode(true)
 				conn.SetWriteDelay(false)
 				conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-				conn.SetMtu(config.MTU)
+				conn.SetMtu(mtu)
 				conn.SetWindowSize(config.SndWnd, config.RcvWnd)
 				conn.SetACKNoDelay(config.AckNodelay)
 
+				var tasks []sessionTask
+				if mode.Auto {
+					// the loss of a session is measured by the adaptive FEC only
+					var loss func() float64
+					if fc != nil {
+						raddr := conn.RemoteAddr()
+						loss = func() float64 { return fc.Loss(raddr) }
+					}
+					tuner := generic.NewAutoTuner(conn, generic.KCPProfile{NoDelay: config.NoDelay, Interval: config.Interval, Resend: config.Resend, NoCongestion: config.NoCongestion, SndWnd: config.SndWnd, RcvWnd: config.RcvWnd}, config.CC != "kcp", loss)
+					tasks = append(tasks, tuner.Run)
+				}
+				if pm != nil {
+					sess := conn
+					tasks = append(tasks, func(closed func() bool) { pm.Run(sess, mtu, overhead, closed) })
+				}
+				if pc != nil {
+					// the controller is created by the task releasing its fair
+					// share, a session ending before its tasks start takes none
+					sess := conn
+					tasks = append(tasks, func(closed func() bool) { pc.Control(sess, newCC(mtu, config.SndWnd), config.RcvWnd, closed) })
+				}
+
 				if config.NoComp {
-					go handleMux(conn, &config)
+					go handleMux(conn, conn.RemoteAddr(), conn.LocalAddr(), pool, rl, adm, pf, q, tasks, g, &config)
 				} else {
-					go handleMux(newCompStream(conn), &config)
+					go handleMux(newCompStream(conn), conn.RemoteAddr(), conn.LocalAddr(), pool, rl, adm, pf, q, tasks, g, &config)
 				}
 			} else {
 				log.Printf("%+v", err)
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// PROXY protocol, see: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyV2CmdLocal = 0x20
+	proxyV2CmdProxy = 0x21
+	proxyV2FamTCP4  = 0x11
+	proxyV2FamTCP6  = 0x21
+)
+
+// writeProxyHeader writes a PROXY protocol header of the given version("v1" or "v2")
+// to w, a header with unknown addresses is emitted if src or dst is unusable.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcaddr, dstaddr := toTCPAddr(src), toTCPAddr(dst)
+	if srcaddr != nil && dstaddr != nil && (srcaddr.IP.To4() == nil) != (dstaddr.IP.To4() == nil) {
+		// address families must match, fall back to an unspecified destination
+		ip := net.IPv6zero
+		if srcaddr.IP.To4() != nil {
+			ip = net.IPv4zero
+		}
+		dstaddr = &net.TCPAddr{IP: ip, Port: dstaddr.Port}
+	}
+
+	var buf []byte
+	switch version {
+	case "v1":
+		buf = proxyHeaderV1(srcaddr, dstaddr)
+	case "v2":
+		buf = proxyHeaderV2(srcaddr, dstaddr)
+	default:
+		return errors.Errorf("unsupported PROXY protocol version: %v", version)
+	}
+	if _, err := w.Write(buf); err != nil {
+		return errors.Wrap(err, "writeProxyHeader")
+	}
+	return nil
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	if src.IP.To4() == nil {
+		proto = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %v %v %v %v %v\r\n", proto, src.IP, dst.IP, src.Port, dst.Port))
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	buf := make([]byte, 16, 16+36)
+	copy(buf, proxyV2Signature)
+	if src == nil || dst == nil {
+		buf[12] = proxyV2CmdLocal
+		return buf
+	}
+
+	buf[12] = proxyV2CmdProxy
+	if ip4 := src.IP.To4(); ip4 != nil {
+		buf[13] = proxyV2FamTCP4
+		buf = append(buf, ip4...)
+		buf = append(buf, dst.IP.To4()...)
+	} else {
+		buf[13] = proxyV2FamTCP6
+		buf = append(buf, src.IP.To16()...)
+		buf = append(buf, dst.IP.To16()...)
+	}
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+	buf = append(buf, ports[:]...)
+	binary.BigEndian.PutUint16(buf[14:], uint16(len(buf)-16))
+	return buf
+}
+
+// toTCPAddr converts kcp(udp) addresses, so they can be carried in a PROXY header
+func toTCPAddr(addr net.Addr) *net.TCPAddr {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr
+	case *net.UDPAddr:
+		return &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// quotaSaveInterval is how often the usage is written to the store
+const quotaSaveInterval = 30 * time.Second
+
+// quotaUser is the traffic of a user in the current period, users are
+// named by the client's --user when it is one of the configured names, or
+// by the peer IP otherwise.
+type quotaUser struct {
+	used int64 // bytes in both directions, accessed atomically
+	soft int64 // overrides of the default limits in bytes, accessed atomically
+	hard int64
+	seen int64 // unix nanoseconds of the last use, accessed atomically
+
+	bucket *bucket // throttles the user past the soft limit
+}
+
+// quotaEntry is a user as saved in the store and reported by the admin interface
+type quotaEntry struct {
+	User string `json:"user,omitempty"`
+	Used int64  `json:"used"`
+	Soft int64  `json:"soft,omitempty"`
+	Hard int64  `json:"hard,omitempty"`
+	Seen int64  `json:"seen,omitempty"` // unix seconds of the last use
+}
+
+// quotaFile is the content of the store
+type quotaFile struct {
+	Start time.Time             `json:"start"`
+	Users map[string]quotaEntry `json:"users"`
+}
+
+// quotaStore accounts the traffic of every user in a json file, users past
+// their soft limit are throttled, users past their hard limit can't open new
+// streams, the usage is reset daily, weekly or monthly. Users unseen for a
+// whole period and without overrides are dropped, as a user is created for
+// every peer IP.
+type quotaStore struct {
+	path     string
+	soft     int64 // default limits in bytes, 0 for unlimited
+	hard     int64
+	rate     int64 // bytes per second past the soft limit, 0 for unlimited
+	schedule string
+	names    map[string]bool // names a client may claim, the header is unauthenticated
+
+	mu    sync.Mutex
+	start time.Time // beginning of the current period
+	users map[string]*quotaUser
+
+	throttled int64  // nanoseconds, accessed atomically
+	refused   uint64 // streams refused past the hard limit, accessed atomically
+}
+
+func newQuotaStore(path string, soft, hard, rate int64, schedule string, names []string) (*quotaStore, error) {
+	switch schedule {
+	case "daily", "weekly", "monthly":
+	default:
+		return nil, errors.Errorf("newQuotaStore: unknown schedule %v", schedule)
+	}
+
+	q := &quotaStore{path: path, soft: soft, hard: hard, rate: rate, schedule: schedule}
+	q.names = make(map[string]bool)
+	for _, name := range names {
+		if name != "" {
+			q.names[name] = true
+		}
+	}
+	q.users = make(map[string]*quotaUser)
+	q.start = periodStart(time.Now(), schedule)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "newQuotaStore")
+	}
+	defer f.Close()
+	var content quotaFile
+	if err := json.NewDecoder(f).Decode(&content); err != nil {
+		return nil, errors.Wrap(err, "newQuotaStore")
+	}
+	for name, e := range content.Users {
+		u := q.newUser()
+		u.used, u.soft, u.hard = e.Used, e.Soft, e.Hard
+		if e.Seen > 0 {
+			u.seen = time.Unix(e.Seen, 0).UnixNano()
+		}
+		q.users[name] = u
+	}
+	q.rotate(content.Start)
+	return q, nil
+}
+
+// periodStart returns the beginning of the period containing t, in UTC
+func periodStart(t time.Time, schedule string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch schedule {
+	case "weekly":
+		// weeks begin on monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "monthly":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+func (q *quotaStore) newUser() *quotaUser {
+	return &quotaUser{seen: time.Now().UnixNano(), bucket: newBucket(&q.rate, &q.throttled)}
+}
+
+// rotate resets the usage if the period starting at start is over and
+// prunes the idle users
+func (q *quotaStore) rotate(start time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	current := periodStart(time.Now(), q.schedule)
+	q.prune(current)
+	if !start.Before(current) {
+		q.start = start
+		return
+	}
+	q.start = current
+	for _, u := range q.users {
+		atomic.StoreInt64(&u.used, 0)
+	}
+	log.Println("quota: usage reset for the period starting", current.Format(time.RFC3339))
+}
+
+// prune drops the users without overrides unseen since the beginning of
+// the period before current, the caller must hold q.mu
+func (q *quotaStore) prune(current time.Time) {
+	previous := periodStart(current.Add(-time.Nanosecond), q.schedule).UnixNano()
+	n := 0
+	for name, u := range q.users {
+		if atomic.LoadInt64(&u.seen) < previous && atomic.LoadInt64(&u.soft) == 0 && atomic.LoadInt64(&u.hard) == 0 {
+			delete(q.users, name)
+			n++
+		}
+	}
+	if n > 0 {
+		log.Println("quota: pruned", n, "idle users")
+	}
+}
+
+// known tells whether a client may be accounted as name, any other name
+// would create an entry in the store for every name a client makes up.
+func (q *quotaStore) known(name string) bool {
+	return q != nil && q.names[name]
+}
+
+// user returns the accounting of name, created on first use
+func (q *quotaStore) user(name string) *quotaUser {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u, ok := q.users[name]
+	if !ok {
+		u = q.newUser()
+		q.users[name] = u
+	}
+	atomic.StoreInt64(&u.seen, time.Now().UnixNano())
+	return u
+}
+
+func (q *quotaStore) limits(u *quotaUser) (soft, hard int64) {
+	soft, hard = q.soft, q.hard
+	if v := atomic.LoadInt64(&u.soft); v > 0 {
+		soft = v
+	}
+	if v := atomic.LoadInt64(&u.hard); v > 0 {
+		hard = v
+	}
+	return
+}
+
+// allowed tells whether u may open a new stream
+func (q *quotaStore) allowed(u *quotaUser) bool {
+	if q == nil {
+		return true
+	}
+	if _, hard := q.limits(u); hard > 0 && atomic.LoadInt64(&u.used) >= hard {
+		atomic.AddUint64(&q.refused, 1)
+		return false
+	}
+	return true
+}
+
+// writer accounts the writes to w to u, throttling past the soft limit
+func (q *quotaStore) writer(w io.Writer, u *quotaUser) io.Writer {
+	if q == nil {
+		return w
+	}
+	return &quotaWriter{Writer: w, q: q, u: u}
+}
+
+type quotaWriter struct {
+	io.Writer
+	q *quotaStore
+	u *quotaUser
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	used := atomic.AddInt64(&w.u.used, int64(len(p)))
+	atomic.StoreInt64(&w.u.seen, time.Now().UnixNano())
+	if soft, _ := w.q.limits(w.u); soft > 0 && used > soft {
+		if d := w.u.bucket.reserve(len(p)); d > 0 {
+			atomic.AddInt64(w.u.bucket.throttled, int64(d))
+			time.Sleep(d)
+		}
+	}
+	return w.Writer.Write(p)
+}
+
+// setLimits overrides the limits of a user, 0 restores the defaults
+func (q *quotaStore) setLimits(name string, soft, hard int64) {
+	u := q.user(name)
+	atomic.StoreInt64(&u.soft, soft)
+	atomic.StoreInt64(&u.hard, hard)
+}
+
+// reset clears the usage of a user
+func (q *quotaStore) reset(name string) {
+	atomic.StoreInt64(&q.user(name).used, 0)
+}
+
+// usage returns every user sorted by name
+func (q *quotaStore) usage() (time.Time, []quotaEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]quotaEntry, 0, len(q.users))
+	for name, u := range q.users {
+		entries = append(entries, quotaEntry{
+			User: name,
+			Used: atomic.LoadInt64(&u.used),
+			Soft: atomic.LoadInt64(&u.soft),
+			Hard: atomic.LoadInt64(&u.hard),
+			Seen: atomic.LoadInt64(&u.seen) / int64(time.Second),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].User < entries[j].User })
+	return q.start, entries
+}
+
+// save writes the store, replacing the file atomically
+func (q *quotaStore) save() error {
+	start, entries := q.usage()
+	content := quotaFile{Start: start, Users: make(map[string]quotaEntry, len(entries))}
+	for _, e := range entries {
+		name := e.User
+		e.User = ""
+		content.Users[name] = e
+	}
+	buf, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "quota: save")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(q.path), filepath.Base(q.path))
+	if err != nil {
+		return errors.Wrap(err, "quota: save")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "quota: save")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "quota: save")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), q.path), "quota: save")
+}
+
+// run resets the usage on schedule, prunes the idle users and saves the
+// store periodically
+func (q *quotaStore) run() {
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.mu.Lock()
+		start := q.start
+		q.mu.Unlock()
+		q.rotate(start)
+		if err := q.save(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// logStats prints the streams refused and the time throttled
+func (q *quotaStore) logStats() {
+	q.mu.Lock()
+	users := len(q.users)
+	q.mu.Unlock()
+	log.Printf("quota: users:%v refused:%v throttled:%v", users,
+		atomic.LoadUint64(&q.refused), time.Duration(atomic.LoadInt64(&q.throttled)))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// graceful tracks in-flight streams and sessions, so the process can wait for
+// the streams to finish and close the sessions before exiting on SIGTERM.
+type graceful struct {
+	mu       sync.Mutex
+	active   int
+	closing  bool
+	die      chan struct{} // closed when the shutdown begins
+	sessions map[*smux.Session]net.Addr
+}
+
+func newGraceful() *graceful {
+	return &graceful{die: make(chan struct{}), sessions: make(map[*smux.Session]net.Addr)}
+}
+
+// track registers a session to be closed on shutdown
+func (g *graceful) track(sess *smux.Session, raddr net.Addr) {
+	g.mu.Lock()
+	g.sessions[sess] = raddr
+	g.mu.Unlock()
+}
+
+func (g *graceful) untrack(sess *smux.Session) {
+	g.mu.Lock()
+	delete(g.sessions, sess)
+	g.mu.Unlock()
+}
+
+// addrs returns the remote addresses of the tracked sessions
+func (g *graceful) addrs() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	addrs := make([]string, 0, len(g.sessions))
+	for _, raddr := range g.sessions {
+		addrs = append(addrs, raddr.String())
+	}
+	return addrs
+}
+
+// closeSessions closes every tracked session
+func (g *graceful) closeSessions() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for sess := range g.sessions {
+		sess.Close()
+	}
+}
+
+// add registers a new stream, it fails once the shutdown has begun
+func (g *graceful) add() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closing {
+		return false
+	}
+	g.active++
+	return true
+}
+
+// done unregisters a stream
+func (g *graceful) done() {
+	g.mu.Lock()
+	g.active--
+	g.mu.Unlock()
+}
+
+func (g *graceful) inflight() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active
+}
+
+// shutdown begins the shutdown, refusing new streams
+func (g *graceful) shutdown() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.closing {
+		g.closing = true
+		close(g.die)
+	}
+}
+
+// wait blocks until every stream has finished or timeout, it reports
+// whether the drain completed.
+func (g *graceful) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		if g.inflight() == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+	return false
+}
+
+// notifyShutdown calls fn on the first SIGTERM or interrupt, a second
+// signal terminates the process immediately.
+func notifyShutdown(fn func()) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-ch
+		log.Println("shutting down on signal:", sig)
+		go fn()
+		sig = <-ch
+		log.Println("forced exit on signal:", sig)
+		os.Exit(1)
+	}()
+}
@@ -17,13 +17,38 @@ func init() {
 
 func sigHandler() {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGUSR1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGHUP)
 	signal.Ignore(syscall.SIGPIPE)
 
 	for {
 		switch <-ch {
 		case syscall.SIGUSR1:
 			log.Printf("KCP SNMP:%+v", kcp.DefaultSnmp.Copy())
+			if limits != nil {
+				limits.logStats()
+			}
+			if peerACL != nil {
+				peerACL.logStats()
+			}
+			if admit != nil {
+				admit.logStats()
+			}
+			if quotas != nil {
+				quotas.logStats()
+			}
+			if fecTotals != nil {
+				fecTotals.LogStats()
+			}
+			if paceTotals != nil {
+				paceTotals.LogStats()
+			}
+		case syscall.SIGHUP:
+			if limits != nil {
+				limits.reload()
+			}
+			if peerACL != nil {
+				peerACL.reload()
+			}
 		}
 	}
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shadowsocks/kcptun/generic"
+)
+
+const (
+	// virtual nodes per backend on the consistent hash ring
+	hashReplicas = 100
+)
+
+// backend is a single target address in a targetPool
+type backend struct {
+	addr  string
+	conns int32 // active connections, accessed atomically
+
+	mu         sync.Mutex
+	down       bool      // marked by active health checks
+	fails      int       // consecutive dial failures
+	ejectUntil time.Time // passively ejected until
+}
+
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.down && !now.Before(b.ejectUntil)
+}
+
+type ringNode struct {
+	hash    uint32
+	backend *backend
+}
+
+// targetPool balances streams over a list of targets, with active health
+// checks and passive ejection of targets that fail to accept connections.
+type targetPool struct {
+	backends    []*backend
+	strategy    string
+	ring        []ringNode
+	rr          uint32
+	maxFails    int
+	failTimeout time.Duration
+}
+
+// newTargetPool creates a pool from a comma separated list of targets,
+// strategy is one of: rr, leastconn, hash
+func newTargetPool(targets, strategy string, maxFails int, failTimeout time.Duration) (*targetPool, error) {
+	pool := new(targetPool)
+	for _, addr := range strings.Split(targets, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			pool.backends = append(pool.backends, &backend{addr: addr})
+		}
+	}
+	if len(pool.backends) == 0 {
+		return nil, errors.New("newTargetPool: no target specified")
+	}
+
+	switch strategy {
+	case "rr", "leastconn":
+	case "hash":
+		for _, b := range pool.backends {
+			for i := 0; i < hashReplicas; i++ {
+				pool.ring = append(pool.ring, ringNode{hashKey(b.addr + "#" + strconv.Itoa(i)), b})
+			}
+		}
+		sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+	default:
+		return nil, errors.Errorf("newTargetPool: unknown strategy %v", strategy)
+	}
+	pool.strategy = strategy
+	pool.maxFails = maxFails
+	pool.failTimeout = failTimeout
+	return pool, nil
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// dial connects to a target chosen by the strategy, key is used by the
+// consistent hash strategy. On failure the next target is tried, until
+// every target has been tried once.
+func (pool *targetPool) dial(key string, timeout time.Duration) (net.Conn, error) {
+	tried := make(map[*backend]bool)
+	var lastErr error
+	for range pool.backends {
+		b := pool.pick(key, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		conn, err := dialTarget(b.addr, timeout)
+		if err != nil {
+			pool.fail(b)
+			lastErr = err
+			continue
+		}
+		pool.succeed(b)
+		atomic.AddInt32(&b.conns, 1)
+		return &targetConn{Conn: conn, backend: b}, nil
+	}
+	return nil, errors.Wrap(lastErr, "all targets failed")
+}
+
+// pick chooses a target not yet tried, preferring available ones
+func (pool *targetPool) pick(key string, tried map[*backend]bool) *backend {
+	now := time.Now()
+	candidate := func(b *backend) bool { return !tried[b] && b.available(now) }
+	if b := pool.pickBy(key, candidate); b != nil {
+		return b
+	}
+	// every remaining target is down, try them anyway
+	return pool.pickBy(key, func(b *backend) bool { return !tried[b] })
+}
+
+func (pool *targetPool) pickBy(key string, candidate func(*backend) bool) *backend {
+	switch pool.strategy {
+	case "leastconn":
+		var best *backend
+		for _, b := range pool.backends {
+			if candidate(b) && (best == nil || atomic.LoadInt32(&b.conns) < atomic.LoadInt32(&best.conns)) {
+				best = b
+			}
+		}
+		return best
+	case "hash":
+		h := hashKey(key)
+		start := sort.Search(len(pool.ring), func(i int) bool { return pool.ring[i].hash >= h })
+		for i := range pool.ring {
+			if b := pool.ring[(start+i)%len(pool.ring)].backend; candidate(b) {
+				return b
+			}
+		}
+		return nil
+	default:
+		start := atomic.AddUint32(&pool.rr, 1)
+		for i := range pool.backends {
+			if b := pool.backends[(int(start)+i)%len(pool.backends)]; candidate(b) {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+func (pool *targetPool) fail(b *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	if pool.maxFails > 0 && b.fails >= pool.maxFails {
+		b.fails = 0
+		b.ejectUntil = time.Now().Add(pool.failTimeout)
+		log.Println("target ejected:", b.addr, "for", pool.failTimeout)
+	}
+}
+
+func (pool *targetPool) succeed(b *backend) {
+	b.mu.Lock()
+	b.fails = 0
+	b.mu.Unlock()
+}
+
+// healthCheck probes every target with a connect at the given interval
+func (pool *targetPool) healthCheck(interval int, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		var wg sync.WaitGroup
+		for _, b := range pool.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				conn, err := dialTarget(b.addr, timeout)
+				if err == nil {
+					conn.Close()
+				}
+
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				if down := err != nil; down != b.down {
+					b.down = down
+					if down {
+						log.Println("target down:", b.addr, err)
+					} else {
+						log.Println("target up:", b.addr)
+					}
+				}
+			}(b)
+		}
+		wg.Wait()
+	}
+}
+
+// targetConn tracks active connections on a backend
+type targetConn struct {
+	net.Conn
+	backend *backend
+	once    sync.Once
+}
+
+func (c *targetConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(&c.backend.conns, -1) })
+	return c.Conn.Close()
+}
+
+func (c *targetConn) CloseWrite() error { return generic.CloseWrite(c.Conn) }
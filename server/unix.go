@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+const unixPrefix = "unix:"
+
+// dialTarget connects to a tcp target, or a unix domain socket when the
+// target looks like "unix:/var/run/app.sock" or "unix:@app"(abstract, linux only)
+func dialTarget(target string, timeout time.Duration) (net.Conn, error) {
+	if strings.HasPrefix(target, unixPrefix) {
+		return net.DialTimeout("unix", strings.TrimPrefix(target, unixPrefix), timeout)
+	}
+	return net.DialTimeout("tcp", target, timeout)
+}